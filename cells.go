@@ -0,0 +1,340 @@
+package main
+
+import (
+	"compress/gzip"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+const (
+	cellsImportBatch = 1000  // количество вышек, сохраняемых за один раз
+	cellDefaultRange = 1000  // радиус действия вышки по умолчанию, м
+	wifiDefaultRange = 100   // радиус действия точки доступа по умолчанию, м
+	cellMinAccuracy  = 50.0  // минимальная погрешность вычисления, м
+	cellSignal       = -90   // уровень сигнала по умолчанию, дБм
+	gsmTimingAdvance = 553.5 // расстояние, соответствующее шагу TA в GSM, м
+	lteTimingAdvance = 78.12 // расстояние, соответствующее шагу TA в LTE, м
+)
+
+// Cell описывает сотовую вышку или точку доступа Wi-Fi в базе данных.
+type Cell struct {
+	ID      string       `bson:"_id"` // идентификатор: MCC-MNC-LAC-CellID или MAC-адрес
+	Radio   string       // тип сети: GSM, UMTS, LTE, CDMA, NR или WIFI
+	Point   Point        // координаты вышки
+	Range   float64      // радиус действия в метрах
+	Samples int          // количество измерений
+	Updated time.Time    // время последнего обновления
+	Learned *CellLearned `bson:",omitempty"` // данные, вычисленные по наблюдениям
+}
+
+// position возвращает координаты и радиус действия вышки. Координаты,
+// вычисленные по достаточному количеству наблюдений, имеют приоритет над
+// загруженными из внешней базы данных.
+func (c Cell) position() (Point, float64, bool) {
+	if c.Learned != nil && c.Learned.Samples >= cellLearnMinSamples {
+		return c.Learned.center(), math.Max(c.Learned.radius(), cellLearnMinRange), true
+	}
+	if c.Point == (Point{}) {
+		return c.Point, 0, false
+	}
+	return c.Point, c.Range, true
+}
+
+// cellKey возвращает идентификатор сотовой вышки.
+func cellKey(mcc, mnc, lac, cid int64) string {
+	return fmt.Sprintf("%d-%d-%d-%d", mcc, mnc, lac, cid)
+}
+
+// cellsDB описывает базу данных сотовых вышек и точек доступа Wi-Fi.
+type cellsDB struct {
+	coll *mgo.Collection // коллекция с описанием вышек
+	wifi *mgo.Collection // коллекция с описанием точек доступа
+}
+
+// cellsColumns содержит порядок колонок в файлах OpenCellID и Mozilla
+// Location Service, если файл не содержит заголовка.
+var cellsColumns = []string{"radio", "mcc", "net", "area", "cell", "unit",
+	"lon", "lat", "range", "samples", "changeable", "created", "updated",
+	"averagesignal"}
+
+// importCells загружает в базу данных описания вышек из файла CSV в формате
+// OpenCellID или Mozilla Location Service и возвращает количество загруженных
+// вышек. Строки с некорректными данными пропускаются.
+func (db *cellsDB) importCells(r io.Reader) (int, error) {
+	session := db.coll.Database.Session.Copy()
+	defer session.Close()
+	coll := session.DB(db.coll.Database.Name).C(db.coll.Name)
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	reader.ReuseRecord = true
+	columns := make(map[string]int)
+	for i, name := range cellsColumns {
+		columns[name] = i
+	}
+	var (
+		bulk    = coll.Bulk()
+		pending int
+		count   int
+		first   = true
+	)
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return count, err
+		}
+		// первая строка может содержать названия колонок
+		if first {
+			// неполные строки перед заголовком пропускаются
+			i := columns["mcc"]
+			if i >= len(record) {
+				continue
+			}
+			first = false
+			if _, err := strconv.Atoi(record[i]); err != nil {
+				columns = make(map[string]int)
+				for i, name := range record {
+					columns[strings.ToLower(strings.TrimSpace(name))] = i
+				}
+				continue
+			}
+		}
+		cell, ok := parseCell(record, columns)
+		if !ok {
+			continue
+		}
+		// вычисленные по наблюдениям данные при загрузке не изменяются
+		bulk.Upsert(bson.M{"_id": cell.ID}, bson.M{"$set": bson.M{
+			"radio":   cell.Radio,
+			"point":   cell.Point,
+			"range":   cell.Range,
+			"samples": cell.Samples,
+			"updated": cell.Updated,
+		}})
+		if pending++; pending == cellsImportBatch {
+			if _, err := bulk.Run(); err != nil {
+				return count, err
+			}
+			count += pending
+			bulk, pending = coll.Bulk(), 0
+		}
+	}
+	if pending > 0 {
+		if _, err := bulk.Run(); err != nil {
+			return count, err
+		}
+		count += pending
+	}
+	return count, nil
+}
+
+// parseCell разбирает описание вышки из строки файла CSV.
+func parseCell(record []string, columns map[string]int) (*Cell, bool) {
+	field := func(name string) string {
+		if i, ok := columns[name]; ok && i < len(record) {
+			return strings.TrimSpace(record[i])
+		}
+		return ""
+	}
+	var ids [4]int64
+	for i, name := range []string{"mcc", "net", "area", "cell"} {
+		id, err := strconv.ParseInt(field(name), 10, 64)
+		if err != nil || id < 0 {
+			return nil, false
+		}
+		ids[i] = id
+	}
+	lon, err := strconv.ParseFloat(field("lon"), 64)
+	if err != nil || lon < -180 || lon > 180 {
+		return nil, false
+	}
+	lat, err := strconv.ParseFloat(field("lat"), 64)
+	if err != nil || lat < -90 || lat > 90 {
+		return nil, false
+	}
+	cell := &Cell{
+		ID:    cellKey(ids[0], ids[1], ids[2], ids[3]),
+		Radio: strings.ToUpper(field("radio")),
+		Point: NewPoint(lon, lat),
+	}
+	cell.Range, _ = strconv.ParseFloat(field("range"), 64)
+	cell.Samples, _ = strconv.Atoi(field("samples"))
+	if updated, err := strconv.ParseInt(field("updated"), 10, 64); err == nil {
+		cell.Updated = time.Unix(updated, 0).UTC()
+	}
+	return cell, true
+}
+
+// importCellsFile загружает в базу данных описания вышек из файла CSV. Файлы
+// с расширением .gz распаковываются.
+func (db *cellsDB) importCellsFile(filename string) (int, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	var r io.Reader = file
+	if strings.HasSuffix(filename, ".gz") {
+		gz, err := gzip.NewReader(file)
+		if err != nil {
+			return 0, err
+		}
+		defer gz.Close()
+		r = gz
+	}
+	return db.importCells(r)
+}
+
+// errUnknownCells возвращается, если в базе данных нет ни одной вышки или
+// точки доступа из запроса.
+var errUnknownCells = errors.New("LBS: no known cells")
+
+// locate вычисляет координаты по известным вышкам и точкам доступа из
+// запроса.
+func (db *cellsDB) locate(req LBSRequest) (*LBSResponse, error) {
+	if len(req.Cells) == 0 && len(req.Wifi) == 0 {
+		return nil, errUnknownCells
+	}
+	session := db.coll.Database.Session.Copy()
+	defer session.Close()
+	var towers []cellTower
+	if len(req.Cells) > 0 {
+		ids := make([]string, len(req.Cells))
+		for i, tower := range req.Cells {
+			ids[i] = tower.key()
+		}
+		known, err := findCells(session.DB(db.coll.Database.Name).C(db.coll.Name), ids)
+		if err != nil {
+			return nil, err
+		}
+		for i, tower := range req.Cells {
+			cell, ok := known[ids[i]]
+			if !ok {
+				continue
+			}
+			point, cellRange, ok := cell.position()
+			if !ok {
+				continue
+			}
+			towers = append(towers, cellTower{
+				point:  point,
+				radius: cellRadius(cellRange, tower.Radio, tower.TimingAdvance),
+				signal: tower.Signal,
+			})
+		}
+	}
+	if len(req.Wifi) > 0 && db.wifi != nil {
+		ids := make([]string, len(req.Wifi))
+		for i, wifi := range req.Wifi {
+			ids[i] = wifi.MAC
+		}
+		known, err := findCells(session.DB(db.wifi.Database.Name).C(db.wifi.Name), ids)
+		if err != nil {
+			return nil, err
+		}
+		for i, wifi := range req.Wifi {
+			cell, ok := known[ids[i]]
+			if !ok {
+				continue
+			}
+			point, wifiRange, ok := cell.position()
+			if !ok {
+				continue
+			}
+			if wifiRange <= 0 {
+				wifiRange = wifiDefaultRange
+			}
+			towers = append(towers, cellTower{
+				point:  point,
+				radius: wifiRange,
+				signal: wifi.Signal,
+			})
+		}
+	}
+	if len(towers) == 0 {
+		return nil, errUnknownCells
+	}
+	point, accuracy := estimatePosition(towers)
+	return &LBSResponse{Point: point, Accuracy: accuracy}, nil
+}
+
+// findCells возвращает описания вышек или точек доступа с указанными
+// идентификаторами.
+func findCells(coll *mgo.Collection, ids []string) (map[string]Cell, error) {
+	var cells []Cell
+	if err := coll.Find(bson.M{"_id": bson.M{"$in": ids}}).All(&cells); err != nil {
+		return nil, err
+	}
+	known := make(map[string]Cell, len(cells))
+	for _, cell := range cells {
+		known[cell.ID] = cell
+	}
+	return known, nil
+}
+
+// cellTower описывает известную вышку, видимую устройством.
+type cellTower struct {
+	point  Point   // координаты вышки
+	radius float64 // максимальное расстояние до устройства, м
+	signal int16   // уровень сигнала, дБм
+}
+
+// cellRadius возвращает максимальное расстояние от вышки до устройства с
+// учетом значения timing advance, если оно известно. Значение timing advance
+// учитывается только для сетей GSM и LTE: для остальных шаг не определен.
+func cellRadius(cellRange float64, radio string, ta uint16) float64 {
+	if cellRange <= 0 {
+		cellRange = cellDefaultRange
+	}
+	if ta == 0 { // значение неизвестно или устройство рядом с вышкой
+		return cellRange
+	}
+	var step float64
+	switch radio {
+	case "gsm":
+		step = gsmTimingAdvance
+	case "lte":
+		step = lteTimingAdvance
+	default:
+		return cellRange
+	}
+	return math.Min(cellRange, (float64(ta)+1)*step)
+}
+
+// estimatePosition вычисляет координаты как центр вышек, взвешенный по уровню
+// сигнала и обратно пропорциональный радиусу действия вышки, и погрешность
+// как взвешенное среднее расстояния до границы действия вышек.
+func estimatePosition(towers []cellTower) (Point, float64) {
+	var lon, lat, sum float64
+	weights := make([]float64, len(towers))
+	for i, tower := range towers {
+		signal := float64(tower.signal)
+		if signal == 0 {
+			signal = cellSignal
+		}
+		// уровень сигнала переводится в амплитуду, чтобы ближние вышки
+		// имели больший вес, но не подавляли остальные полностью
+		weights[i] = math.Pow(10, signal/20) / tower.radius
+		lon += tower.point[0] * weights[i]
+		lat += tower.point[1] * weights[i]
+		sum += weights[i]
+	}
+	center := NewPoint(lon/sum, lat/sum)
+	var accuracy float64
+	for i, tower := range towers {
+		accuracy += (Distance(center, tower.point) + tower.radius) * weights[i]
+	}
+	return center, math.Max(accuracy/sum, cellMinAccuracy)
+}
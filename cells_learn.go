@@ -0,0 +1,175 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"math"
+	"time"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+const (
+	cellLearnMinSamples  = 3     // количество наблюдений для использования координат
+	cellLearnMinRange    = 50.0  // минимальный радиус действия, м
+	cellLearnMaxAccuracy = 200.0 // максимальная погрешность наблюдения, м
+	cellLearnMinAccuracy = 10.0  // погрешность, лучше которой не учитывается, м
+)
+
+// CellLearned описывает координаты вышки или точки доступа, вычисленные по
+// наблюдениям: координатам GPS, полученным вместе с ее сигналом.
+type CellLearned struct {
+	SumLon  float64 // сумма долгот наблюдений с весами
+	SumLat  float64 // сумма широт наблюдений с весами
+	SumLon2 float64 // сумма квадратов долгот наблюдений с весами
+	SumLat2 float64 // сумма квадратов широт наблюдений с весами
+	Weight  float64 // сумма весов наблюдений
+	Samples int     // количество наблюдений
+}
+
+// center возвращает центр наблюдений.
+func (l CellLearned) center() Point {
+	return NewPoint(l.SumLon/l.Weight, l.SumLat/l.Weight)
+}
+
+// radius возвращает радиус действия как удвоенное среднеквадратичное
+// отклонение наблюдений от центра. В отличие от наибольшего расстояния он не
+// растет навсегда из-за одного ошибочного наблюдения.
+func (l CellLearned) radius() float64 {
+	center := l.center()
+	varLon := math.Max(l.SumLon2/l.Weight-center[0]*center[0], 0)
+	varLat := math.Max(l.SumLat2/l.Weight-center[1]*center[1], 0)
+	// перевод градусов в метры
+	scale := earthRadius * math.Pi / 180
+	varLon *= scale * scale * math.Pow(math.Cos(center[1]*math.Pi/180), 2)
+	varLat *= scale * scale
+	return 2 * math.Sqrt(varLon+varLat)
+}
+
+// LBSObservation описывает координаты GPS и видимые в этой точке сотовые
+// вышки и точки доступа Wi-Fi.
+type LBSObservation struct {
+	Point    Point      // координаты GPS
+	Accuracy float64    // погрешность координат GPS, м
+	Time     time.Time  // время определения координат
+	Request  LBSRequest // видимые вышки и точки доступа
+	Device   string     // идентификатор устройства
+}
+
+// LBSObserveResponse описывает результат учета наблюдения.
+type LBSObserveResponse struct {
+	Cells int // количество учтенных вышек
+	Wifi  int // количество учтенных точек доступа
+	// расстояние от координат GPS до координат, вычисленных по базе данных до
+	// учета наблюдения, или -1, если вычислить их было нельзя
+	Error float64
+}
+
+// Observe учитывает наблюдение в базе данных вышек и точек доступа: их
+// координаты вычисляются как средние координаты наблюдений с весами, обратно
+// пропорциональными квадрату погрешности, а радиус действия — по разбросу
+// наблюдений относительно центра. Наблюдения с большой погрешностью не
+// учитываются.
+func (s *LBS) Observe(obs LBSObservation, resp *LBSObserveResponse) error {
+	if s.cells == nil {
+		return errors.New("LBS: service not initialized")
+	}
+	// NaN не проходит ни одно сравнение, поэтому проверяется отдельно: иначе
+	// он навсегда испортит суммы для всех вышек из наблюдения
+	if !isFinite(obs.Point[0]) || !isFinite(obs.Point[1]) ||
+		!isFinite(obs.Accuracy) {
+		return errors.New("LBS: bad observation")
+	}
+	if obs.Point[0] < -180 || obs.Point[0] > 180 ||
+		obs.Point[1] < -90 || obs.Point[1] > 90 {
+		return errors.New("LBS: bad observation point")
+	}
+	if obs.Accuracy <= 0 || obs.Accuracy > cellLearnMaxAccuracy {
+		return errors.New("LBS: observation accuracy too low")
+	}
+	if err := obs.Request.normalize(); err != nil {
+		return err
+	}
+	// случайные адреса и точки доступа мобильных устройств не имеют
+	// постоянных координат
+	filterWifi(&obs.Request, 1)
+	resp.Error = -1
+	if estimate, err := s.cells.locate(obs.Request); err == nil {
+		resp.Error = Distance(estimate.Point, obs.Point)
+	}
+	if obs.Time.IsZero() {
+		obs.Time = time.Now()
+	}
+	// координаты GPS используются для проверки правдоподобности ответов
+	if s.Plausibility != nil && obs.Device != "" {
+		last, err := s.Plausibility.last(obs.Device)
+		if err != nil {
+			return err
+		}
+		if last == nil || obs.Time.After(last.Time) {
+			err = s.Plausibility.save(lbsDevicePosition{
+				Device:   obs.Device,
+				Point:    obs.Point,
+				Accuracy: obs.Accuracy,
+				Time:     obs.Time,
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+	// координаты GPS используются для калибровки погрешности ответов; ее
+	// ошибка не должна мешать учету наблюдения
+	if err := s.Calibration.truth(obs.Device, obs.Point, obs.Accuracy,
+		obs.Time); err != nil {
+		log.Println("LBS: calibration error:", err)
+	}
+	return s.cells.learn(obs, resp)
+}
+
+// learn учитывает наблюдение для всех вышек и точек доступа из него.
+func (db *cellsDB) learn(obs LBSObservation, resp *LBSObserveResponse) error {
+	session := db.coll.Database.Session.Copy()
+	defer session.Close()
+	cells := session.DB(db.coll.Database.Name).C(db.coll.Name)
+	for _, tower := range obs.Request.Cells {
+		if err := learnCell(cells, tower.key(), obs); err != nil {
+			return err
+		}
+		resp.Cells++
+	}
+	wifi := session.DB(db.wifi.Database.Name).C(db.wifi.Name)
+	for _, ap := range obs.Request.Wifi {
+		if err := learnCell(wifi, ap.MAC, obs); err != nil {
+			return err
+		}
+		resp.Wifi++
+	}
+	return nil
+}
+
+// learnCell учитывает наблюдение для вышки или точки доступа. Все суммы
+// обновляются одной атомарной операцией.
+func learnCell(coll *mgo.Collection, id string, obs LBSObservation) error {
+	accuracy := math.Max(obs.Accuracy, cellLearnMinAccuracy)
+	weight := 1 / (accuracy * accuracy)
+	lon, lat := obs.Point[0], obs.Point[1]
+	_, err := coll.UpsertId(id, bson.M{
+		"$inc": bson.M{
+			"learned.sumlon":  lon * weight,
+			"learned.sumlat":  lat * weight,
+			"learned.sumlon2": lon * lon * weight,
+			"learned.sumlat2": lat * lat * weight,
+			"learned.weight":  weight,
+			"learned.samples": 1,
+		},
+		"$max": bson.M{"updated": obs.Time},
+	})
+	return err
+}
+
+// isFinite возвращает true, если значение не является NaN или бесконечностью.
+func isFinite(v float64) bool {
+	return !math.IsNaN(v) && !math.IsInf(v, 0)
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestParseCell(t *testing.T) {
+	columns := make(map[string]int)
+	for i, name := range cellsColumns {
+		columns[name] = i
+	}
+	record := []string{"LTE", "250", "1", "6101", "4765", "0", "37.6", "55.7",
+		"1500", "12", "1", "1459814400", "1474243200", "0"}
+	cell, ok := parseCell(record, columns)
+	if !ok {
+		t.Fatal("cell not parsed")
+	}
+	if cell.ID != "250-1-6101-4765" || cell.Radio != "LTE" ||
+		cell.Point != NewPoint(37.6, 55.7) || cell.Range != 1500 ||
+		cell.Samples != 12 || cell.Updated.Unix() != 1474243200 {
+		t.Error("bad cell:", cell)
+	}
+	record[7] = "95"
+	if _, ok := parseCell(record, columns); ok {
+		t.Error("bad latitude accepted")
+	}
+}
+
+func TestEstimatePosition(t *testing.T) {
+	towers := []cellTower{
+		{point: NewPoint(37.60, 55.7), radius: 1000, signal: -60},
+		{point: NewPoint(37.62, 55.7), radius: 1000, signal: -90},
+	}
+	point, accuracy := estimatePosition(towers)
+	// координаты ближе к вышке с более сильным сигналом
+	if d := Distance(point, towers[0].point); d > Distance(point, towers[1].point) {
+		t.Error("bad position:", point)
+	}
+	if accuracy < 1000 || accuracy > 2300 {
+		t.Error("bad accuracy:", accuracy)
+	}
+	if r := cellRadius(5000, "gsm", 1); r != 2*gsmTimingAdvance {
+		t.Error("bad timing advance radius:", r)
+	}
+	// максимальное значение не переполняется, а для сетей без шага timing
+	// advance оно не учитывается
+	if r := cellRadius(1e7, "lte", math.MaxUint16); r != 65536*lteTimingAdvance {
+		t.Error("bad maximum timing advance radius:", r)
+	}
+	if r := cellRadius(5000, "wcdma", math.MaxUint16); r != 5000 {
+		t.Error("timing advance used for wcdma:", r)
+	}
+}
+
+func TestCellPosition(t *testing.T) {
+	cell := Cell{Point: NewPoint(37.6, 55.7), Range: 2000}
+	if point, r, ok := cell.position(); !ok || point != cell.Point || r != 2000 {
+		t.Error("bad imported position:", point, r, ok)
+	}
+	// вычисленные по наблюдениям координаты используются при достаточном
+	// количестве наблюдений
+	cell.Learned = &CellLearned{
+		SumLon: 37.5*1 + 37.7*3, SumLat: 55.8 * 4, Weight: 4, Samples: 2,
+		SumLon2: 37.5*37.5*1 + 37.7*37.7*3, SumLat2: 55.8 * 55.8 * 4,
+	}
+	if point, _, _ := cell.position(); point != cell.Point {
+		t.Error("learned position used too early")
+	}
+	cell.Learned.Samples = cellLearnMinSamples
+	point, r, ok := cell.position()
+	// среднеквадратичное отклонение долготы 0.0866° на широте 55.8°
+	if !ok || Distance(point, NewPoint(37.65, 55.8)) > 1 || math.Abs(r-10860) > 100 {
+		t.Error("bad learned position:", point, r, ok)
+	}
+	// совпадающие наблюдения дают минимальный радиус
+	cell.Learned.SumLon2 = 37.65 * 37.65 * 4
+	cell.Learned.SumLon = 37.65 * 4
+	if _, r, _ := cell.position(); r != cellLearnMinRange {
+		t.Error("bad minimal learned range:", r)
+	}
+	if _, _, ok := (Cell{}).position(); ok {
+		t.Error("unknown position")
+	}
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// compressedData описывает двоичные данные, которые хранятся в базе данных в
+// сжатом виде. Данные, сохраненные ранее без сжатия, читаются как есть.
+type compressedData []byte
+
+// GetBSON возвращает сжатое представление данных.
+// Поддерживает интерфейс кодирования BSON.
+func (d compressedData) GetBSON() (interface{}, error) {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	if _, err := gz.Write(d); err != nil {
+		return nil, err
+	}
+	if err := gz.Close(); err != nil {
+		return nil, err
+	}
+	return struct{ Gzip []byte }{buf.Bytes()}, nil
+}
+
+// SetBSON распаковывает сжатые данные.
+// Поддерживает интерфейс декодирования BSON.
+func (d *compressedData) SetBSON(raw bson.Raw) error {
+	if raw.Kind == 0x05 { // двоичные данные без сжатия
+		var data []byte
+		if err := raw.Unmarshal(&data); err != nil {
+			return err
+		}
+		*d = data
+		return nil
+	}
+	var packed struct{ Gzip []byte }
+	if err := raw.Unmarshal(&packed); err != nil {
+		return err
+	}
+	gz, err := gzip.NewReader(bytes.NewReader(packed.Gzip))
+	if err != nil {
+		return err
+	}
+	data, err := ioutil.ReadAll(gz)
+	if err != nil {
+		return err
+	}
+	*d = data
+	return nil
+}
+
+// errResponseTooLarge возвращается, если размер ответа превышает допустимый.
+var errResponseTooLarge = errors.New("response too large")
+
+// readLimited читает данные, размер которых не должен превышать указанного.
+// Если размер не задан, то данные читаются без ограничений.
+func readLimited(r io.Reader, maxSize int64) ([]byte, error) {
+	if maxSize <= 0 {
+		return ioutil.ReadAll(r)
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(r, maxSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > maxSize {
+		return nil, errResponseTooLarge
+	}
+	return data, nil
+}
+
+// gzipHandler возвращает обработчик HTTP-запросов, который сжимает ответы,
+// если клиент это поддерживает. Ответы на запросы частей данных (Range) не
+// сжимаются, потому что диапазоны относятся к несжатым данным.
+func gzipHandler(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Accept-Encoding")
+		if r.Method == "HEAD" || r.Header.Get("Range") != "" ||
+			!strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
+			handler.ServeHTTP(w, r)
+			return
+		}
+		gw := &gzipResponseWriter{ResponseWriter: w}
+		handler.ServeHTTP(gw, r)
+		if gw.gz != nil {
+			gw.gz.Close()
+		}
+	})
+}
+
+// gzipResponseWriter сжимает содержимое ответа на HTTP-запрос.
+type gzipResponseWriter struct {
+	http.ResponseWriter
+	gz          *gzip.Writer // сжатие данных ответа
+	wroteHeader bool         // заголовок ответа отправлен
+}
+
+// WriteHeader отправляет заголовок ответа. Сжимаются только успешные ответы
+// с содержимым.
+func (w *gzipResponseWriter) WriteHeader(code int) {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+	header := w.Header()
+	if code == http.StatusOK && header.Get("Content-Encoding") == "" {
+		header.Del("Content-Length")
+		header.Set("Content-Encoding", "gzip")
+		w.gz = gzip.NewWriter(w.ResponseWriter)
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+// Write записывает содержимое ответа.
+func (w *gzipResponseWriter) Write(data []byte) (int, error) {
+	if !w.wroteHeader {
+		if w.Header().Get("Content-Type") == "" {
+			w.Header().Set("Content-Type", http.DetectContentType(data))
+		}
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.gz != nil {
+		return w.gz.Write(data)
+	}
+	return w.ResponseWriter.Write(data)
+}
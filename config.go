@@ -2,16 +2,13 @@ package main
 
 import (
 	"encoding/json"
-	"fmt"
+	"errors"
 	"io/ioutil"
 	"net"
 	"net/http"
 	"net/rpc"
-	"strings"
 	"time"
 
-	"github.com/mdigger/geolocate"
-
 	"gopkg.in/mgo.v2"
 )
 
@@ -27,6 +24,9 @@ type Config struct {
 	POI     *POI     // настройки сервиса POI
 	Devices *Devices // хранилище данных по устройствам
 	Store   *Store   // хранилище файлов
+	Usage   *Usage   // учет запросов к платным внешним сервисам
+	Geocode *Geocode // определение адреса по координатам
+	Gzip    bool     // сжимать ответы HTTP-обработчиков
 
 	listener net.Listener // TCP-сервер
 }
@@ -50,22 +50,27 @@ func LoadConfig(filename string) (*Config, error) {
 // индексы в базе данных корректно инициализированы.
 func (c *Config) Run(addr string) (err error) {
 	// инициализируем соединение с MongoDB
-	if c.MongoDB == "" {
-		c.MongoDB = "mongodb://localhost/"
-	}
-	di, err := mgo.ParseURL(c.MongoDB) // разбираем строку соединения
+	session, di, err := c.dial()
 	if err != nil {
 		return err
 	}
-	if di.Database == "" {
-		di.Database = "trackintouch"
-	}
-	session, err := mgo.DialWithInfo(di) // устанавливаем соединение
-	if err != nil {
-		return err
+	// инициализируем учет запросов к внешним сервисам до запуска фоновых
+	// задач, которые к ним обращаются
+	if c.Usage != nil {
+		c.Usage.coll = session.DB(di.Database).C("usage")
+		err = c.Usage.coll.EnsureIndexKey("date", "provider", "device")
+		if err != nil {
+			return err
+		}
+		// регистрируем обработчик
+		err = rpc.Register(c.Usage)
+		if err != nil {
+			return err
+		}
 	}
 	// инициализируем сервис U-blox и индексы
 	if c.Ublox != nil {
+		c.Ublox.usage = c.Usage
 		// инициализируем коллекцию для кеширования ответов
 		coll := session.DB(di.Database).C("ublox")
 		c.Ublox.coll = coll
@@ -74,13 +79,33 @@ func (c *Config) Run(addr string) (err error) {
 		if err != nil {
 			return err
 		}
-		// индекс времени жизни данных в кеш
+		// время кеширования данных без эфемерид и альманахов
 		if c.Ublox.CacheTime <= 0 {
 			c.Ublox.CacheTime = time.Minute * 30
 		}
+		// индекс времени жизни данных в кеш: время окончания действия данных
+		// вычисляется для каждого ответа отдельно, поэтому ранее созданный
+		// индекс с фиксированным временем жизни удаляется
+		coll.DropIndex("time")
 		err = coll.EnsureIndex(mgo.Index{
+			Key:         []string{"expire"},
+			ExpireAfter: time.Second,
+		})
+		if err != nil {
+			return err
+		}
+		// инициализируем кеш данных в памяти
+		if c.Ublox.MemoryCache > 0 {
+			c.Ublox.memory = newUbloxMemCache(c.Ublox.MemoryCache)
+		}
+		// инициализируем коллекцию наборов данных для загрузки частями
+		c.Ublox.contents = session.DB(di.Database).C("ublox_content")
+		if c.Ublox.ContentTime <= 0 {
+			c.Ublox.ContentTime = time.Minute * 10
+		}
+		err = c.Ublox.contents.EnsureIndex(mgo.Index{
 			Key:         []string{"time"},
-			ExpireAfter: c.Ublox.CacheTime,
+			ExpireAfter: c.Ublox.ContentTime,
 		})
 		if err != nil {
 			return err
@@ -90,31 +115,198 @@ func (c *Config) Run(addr string) (err error) {
 			c.Ublox.Timeout = time.Minute * 2
 		}
 		c.Ublox.client = &http.Client{Timeout: c.Ublox.Timeout}
+		// ответы серверов U-blox не превышают нескольких сотен килобайт
+		if c.Ublox.MaxResponseSize <= 0 {
+			c.Ublox.MaxResponseSize = 4 << 20
+		}
+		// по умолчанию видимость спутников проверяется на ближайший час
+		if c.Ublox.VisibilityWindow <= 0 {
+			c.Ublox.VisibilityWindow = time.Hour
+		}
+		// эфемериды устройства старше двух часов передаются повторно
+		if c.Ublox.DeltaMaxAge <= 0 {
+			c.Ublox.DeltaMaxAge = time.Hour * 2
+		}
+		// по умолчанию сервер пропускается на минуту после трех ошибок подряд
+		if c.Ublox.BreakerErrors <= 0 {
+			c.Ublox.BreakerErrors = 3
+		}
+		if c.Ublox.BreakerCooldown <= 0 {
+			c.Ublox.BreakerCooldown = time.Minute
+		}
+		// инициализируем периодическую загрузку данных AssistNow Offline
+		if offline := c.Ublox.Offline; offline != nil {
+			if len(offline.Servers) == 0 {
+				return errors.New("UBLOX: no offline servers")
+			}
+			if offline.Interval <= 0 {
+				offline.Interval = time.Hour * 24
+			}
+			offline.coll = session.DB(di.Database).C("ublox_offline")
+			offline.done = make(chan struct{})
+			go c.Ublox.runOffline(offline.done)
+		}
+		// инициализируем фоновое обновление популярных данных
+		if refresh := c.Ublox.Refresh; refresh != nil {
+			if refresh.Before <= 0 {
+				refresh.Before = time.Minute * 5
+			}
+			if refresh.Budget <= 0 {
+				refresh.Budget = 60
+			}
+			if refresh.MinHits <= 0 {
+				refresh.MinHits = 2
+			}
+			if refresh.MaxRegions <= 0 {
+				refresh.MaxRegions = 10000
+			}
+			refresh.done = make(chan struct{})
+			go c.Ublox.runRefresh(refresh.done)
+		}
 		// регистрируем обработчик
 		err = rpc.Register(c.Ublox)
 		if err != nil {
 			return err
 		}
+		c.Ublox.prefix = "/ublox/"
+		http.Handle(c.Ublox.prefix, c.handler(c.Ublox))
+		if c.Ublox.AdminToken != "" {
+			http.Handle("/admin/ublox/", c.handler(&ubloxAdmin{
+				ublox: c.Ublox,
+				token: c.Ublox.AdminToken,
+			}))
+		}
 	}
 	// инициализируем сервис LBS
 	if c.LBS != nil {
-		// в зависимости от типа инициализируем разные сервисы LBS
-		var serviceURL string
-		switch strings.ToLower(c.LBS.Type) {
-		case "mozilla":
-			serviceURL = geolocate.Mozilla
-		case "google":
-			serviceURL = geolocate.Google
-		case "yandex":
-			serviceURL = geolocate.Yandex
-		default:
-			return fmt.Errorf("unknown LBS service name: %s", c.LBS.Type)
-		}
-		locator, err := geolocate.New(serviceURL, c.LBS.Token)
+		c.LBS.usage = c.Usage
+		// инициализируем базу данных сотовых вышек
+		c.LBS.cells = &cellsDB{
+			coll: session.DB(di.Database).C("cells"),
+			wifi: session.DB(di.Database).C("wifi"),
+		}
+		err = c.LBS.cells.coll.EnsureIndexKey("$2dsphere:point")
 		if err != nil {
 			return err
 		}
-		c.LBS.locator = locator
+		// ответы сервиса геолокации занимают не больше нескольких килобайт
+		if c.LBS.MaxResponseSize <= 0 {
+			c.LBS.MaxResponseSize = 1 << 16
+		}
+		// внешние сервисы не используют для вычисления одну точку доступа
+		if c.LBS.MinWifi <= 0 {
+			c.LBS.MinWifi = 2
+		}
+		if c.LBS.Parallelism <= 0 {
+			c.LBS.Parallelism = 4
+		}
+		for i := range c.LBS.Providers {
+			if c.LBS.Providers[i].Timeout <= 0 {
+				c.LBS.Providers[i].Timeout = lbsTimeout
+			}
+		}
+		// инициализируем внешние сервисы геолокации
+		if err := c.LBS.init(); err != nil {
+			return err
+		}
+		// инициализируем проверку правдоподобности координат
+		if plausibility := c.LBS.Plausibility; plausibility != nil {
+			if plausibility.MaxSpeed <= 0 {
+				plausibility.MaxSpeed = 55 // 200 км/ч
+			}
+			if plausibility.MaxAge <= 0 {
+				plausibility.MaxAge = time.Hour * 12
+			}
+			if plausibility.Retries <= 0 {
+				plausibility.Retries = 2
+			}
+			if plausibility.SeedAccuracy <= 0 {
+				plausibility.SeedAccuracy = 100
+			}
+			plausibility.coll = session.DB(di.Database).C("lbs_devices")
+		}
+		// инициализируем калибровку погрешности ответов
+		if calibration := c.LBS.Calibration; calibration != nil {
+			if calibration.Window <= 0 {
+				calibration.Window = time.Minute
+			}
+			if calibration.MaxAge <= 0 {
+				calibration.MaxAge = time.Hour * 24 * 30
+			}
+			if calibration.MaxAccuracy <= 0 {
+				calibration.MaxAccuracy = 50
+			}
+			if calibration.Precision <= 0 {
+				calibration.Precision = 3 // около 150 км
+			}
+			if calibration.MinSamples <= 0 {
+				calibration.MinSamples = 50
+			}
+			if calibration.Percentile <= 0 || calibration.Percentile >= 1 {
+				calibration.Percentile = 0.68
+			}
+			if calibration.Interval <= 0 {
+				calibration.Interval = time.Hour
+			}
+			// ответы ожидают координат GPS не дольше двух интервалов
+			// сравнения с момента сохранения: время измерения для ответов
+			// на отложенные запросы пакета может быть намного раньше
+			calibration.answers = session.DB(di.Database).C("lbs_answers")
+			err = calibration.answers.EnsureIndexKey("device", "time")
+			if err != nil {
+				return err
+			}
+			// индекс по времени измерения из прежних версий удаляет такие
+			// ответы сразу после сохранения
+			calibration.answers.DropIndex("time")
+			err = calibration.answers.EnsureIndex(mgo.Index{
+				Key:         []string{"created"},
+				ExpireAfter: calibration.Window * 2,
+			})
+			if err != nil {
+				return err
+			}
+			calibration.coll = session.DB(di.Database).C("lbs_errors")
+			err = calibration.coll.EnsureIndexKey("provider", "region", "-time")
+			if err != nil {
+				return err
+			}
+			err = calibration.coll.EnsureIndex(mgo.Index{
+				Key:         []string{"time"},
+				ExpireAfter: calibration.MaxAge,
+			})
+			if err != nil {
+				return err
+			}
+		}
+		// инициализируем кеш ответов
+		if cache := c.LBS.Cache; cache != nil {
+			if cache.Time <= 0 {
+				cache.Time = time.Hour
+			}
+			if cache.Similarity <= 0 || cache.Similarity > 1 {
+				cache.Similarity = 0.8
+			}
+			if cache.Signal <= 0 {
+				cache.Signal = 10
+			}
+			cache.coll = session.DB(di.Database).C("lbs_cache")
+			err = cache.coll.EnsureIndexKey("fingerprint.cells")
+			if err != nil {
+				return err
+			}
+			err = cache.coll.EnsureIndexKey("fingerprint.wifi")
+			if err != nil {
+				return err
+			}
+			err = cache.coll.EnsureIndex(mgo.Index{
+				Key:         []string{"time"},
+				ExpireAfter: cache.Time,
+			})
+			if err != nil {
+				return err
+			}
+		}
 		// регистрируем обработчик
 		err = rpc.Register(c.LBS)
 		if err != nil {
@@ -161,7 +353,25 @@ func (c *Config) Run(addr string) (err error) {
 		if err != nil {
 			return err
 		}
-		http.Handle(c.Store.prefix, c.Store)
+		http.Handle(c.Store.prefix, c.handler(c.Store))
+	}
+	// инициализируем определение адреса по координатам
+	if c.Geocode != nil {
+		if c.Geocode.AddressDistance <= 0 {
+			c.Geocode.AddressDistance = 100
+		}
+		if c.Geocode.LocalityDistance <= 0 {
+			c.Geocode.LocalityDistance = 30000
+		}
+		c.Geocode.coll = session.DB(di.Database).C("geocode")
+		if err := c.Geocode.ensureIndex(); err != nil {
+			return err
+		}
+		// регистрируем обработчик
+		err = rpc.Register(c.Geocode)
+		if err != nil {
+			return err
+		}
 	}
 	// регистрируем сервис, возвращающий информацию о временных зонах
 	// по гео-координатам
@@ -185,8 +395,71 @@ func (c *Config) Run(addr string) (err error) {
 	return err
 }
 
+// handler возвращает обработчик HTTP-запросов, который сжимает ответы, если
+// это задано в конфигурации.
+func (c *Config) handler(handler http.Handler) http.Handler {
+	if c.Gzip {
+		return gzipHandler(handler)
+	}
+	return handler
+}
+
+// dial устанавливает соединение с MongoDB.
+func (c *Config) dial() (*mgo.Session, *mgo.DialInfo, error) {
+	if c.MongoDB == "" {
+		c.MongoDB = "mongodb://localhost/"
+	}
+	di, err := mgo.ParseURL(c.MongoDB) // разбираем строку соединения
+	if err != nil {
+		return nil, nil, err
+	}
+	if di.Database == "" {
+		di.Database = "trackintouch"
+	}
+	session, err := mgo.DialWithInfo(di) // устанавливаем соединение
+	if err != nil {
+		return nil, nil, err
+	}
+	return session, di, nil
+}
+
+// ImportCells загружает в базу данных описания сотовых вышек из файла CSV в
+// формате OpenCellID или Mozilla Location Service и возвращает количество
+// загруженных вышек.
+func (c *Config) ImportCells(filename string) (int, error) {
+	session, di, err := c.dial()
+	if err != nil {
+		return 0, err
+	}
+	defer session.Close()
+	cells := &cellsDB{coll: session.DB(di.Database).C("cells")}
+	if err := cells.coll.EnsureIndexKey("$2dsphere:point"); err != nil {
+		return 0, err
+	}
+	return cells.importCellsFile(filename)
+}
+
+// ImportGazetteer загружает в справочник адресов объекты из выгрузки GeoNames
+// или файла адресов OpenAddresses и возвращает количество загруженных
+// объектов.
+func (c *Config) ImportGazetteer(filename string) (int, error) {
+	session, di, err := c.dial()
+	if err != nil {
+		return 0, err
+	}
+	defer session.Close()
+	geocode := &Geocode{coll: session.DB(di.Database).C("geocode")}
+	if err := geocode.ensureIndex(); err != nil {
+		return 0, err
+	}
+	return geocode.importGazetteerFile(filename)
+}
+
 // Close закрывает подключение к сервису и останавливает его.
 func (c *Config) Close() {
+	if c.Ublox != nil {
+		c.Ublox.close()
+	}
 	if c.listener != nil {
 		c.listener.Close()
 		c.listener = nil
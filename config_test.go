@@ -3,6 +3,7 @@ package main
 import (
 	"fmt"
 	"net/http"
+	"net/http/httptest"
 	"net/rpc"
 	"os"
 	"strings"
@@ -11,14 +12,15 @@ import (
 )
 
 func TestConfig(t *testing.T) {
+	// вместо серверов U-blox используется их имитация
+	simulator := httptest.NewServer(&UbloxSimulator{Token: "test"})
+	defer simulator.Close()
+
 	service := &Config{
 		MongoDB: "mongodb://localhost/testtits",
 		Ublox: &Ublox{
-			Token: os.Getenv("Ublox"),
-			Servers: []string{
-				"http://online-live1.services.u-blox.com/GetOnlineData.ashx",
-				"http://online-live2.services.u-blox.com/GetOnlineData.ashx",
-			},
+			Token:       "test",
+			Servers:     []string{simulator.URL},
 			Timeout:     time.Minute * 2,
 			CacheTime:   time.Minute * 2,
 			MaxDistance: 10000.0,
@@ -77,54 +79,18 @@ func TestConfig(t *testing.T) {
 
 	// LBS
 
-	type CellTower struct {
-		MobileCountryCode uint16 // The mobile country code.
-		MobileNetworkCode uint16 // The mobile network code.
-		LocationAreaCode  uint16 // The location area code for GSM and WCDMA networks. The tracking area code for LTE networks.
-		CellId            uint32 // The cell id or cell identity.
-		SignalStrength    int16  // The signal strength for this cell network, either the RSSI or RSCP.
-		Age               uint32 // The number of milliseconds since this networks was last detected.
-		TimingAdvance     uint8  // The timing advance value for this cell network.
-	}
-
-	type WifiAccessPoint struct {
-		MacAddress         string // The BSSID of the WiFi network.
-		SignalStrength     int16  // The received signal strength (RSSI) in dBm.
-		Age                uint32 // The number of milliseconds since this network was last detected.
-		Channel            uint8  // The WiFi channel, often 1 - 13 for networks in the 2.4GHz range.
-		SignalToNoiseRatio uint16 // The current signal to noise ratio measured in dB.
-	}
-
-	type Fallbacks struct {
-		LAC bool // If no exact cell match can be found, fall back from exact cell position estimates to more coarse grained cell location area estimates, rather than going directly to an even worse GeoIP based estimate.
-		IP  bool // If no position can be estimated based on any of the provided data points, fall back to an estimate based on a GeoIP database based on the senders IP address at the time of the query.
-	}
-
-	type LBSRequest struct {
-		HomeMobileCountryCode uint16            // The mobile country code stored on the SIM card (100-999).
-		HomeMobileNetworkCode uint16            // The mobile network code stored on the SIM card (0-32767).
-		RadioType             string            // The mobile radio type. Supported values are lte, gsm, cdma, and wcdma.
-		Carrier               string            // The clear text name of the cell carrier / operator.
-		ConsiderIp            bool              // Should the clients IP address be used to locate it, defaults to true.
-		CellTowers            []CellTower       // Array of cell towers
-		WifiAccessPoints      []WifiAccessPoint // Array of wifi access points
-		IPAddress             string            // Client IP Address
-		Fallbacks             *Fallbacks        // The fallback section is a custom addition to the GLS API.
-	}
-
 	lbsRequest := LBSRequest{
-		RadioType:             "gsm",
-		HomeMobileCountryCode: 250,
-		HomeMobileNetworkCode: 1,
-		ConsiderIp:            false,
-		CellTowers: []CellTower{
-			{250, 1, 6101, 4765, -62, 0, 0},
-			{250, 1, 6101, 4762, -56, 0, 0},
-			{250, 1, 6101, 4763, -60, 0, 0},
-			{250, 1, 6101, 4766, -75, 0, 0},
-			{250, 1, 818, 13000, -87, 0, 0},
-			{250, 1, 818, 13049, -83, 0, 0},
-			{250, 1, 6101, 4761, -76, 0, 0},
+		RadioType: "gsm",
+		HomeMCC:   250,
+		HomeMNC:   1,
+		Cells: []LBSCell{
+			{MCC: 250, MNC: 1, LAC: 6101, CellID: 4765, Signal: -62},
+			{MCC: 250, MNC: 1, LAC: 6101, CellID: 4762, Signal: -56},
+			{MCC: 250, MNC: 1, LAC: 6101, CellID: 4763, Signal: -60},
+			{MCC: 250, MNC: 1, LAC: 6101, CellID: 4766, Signal: -75},
+			{MCC: 250, MNC: 1, LAC: 818, CellID: 13000, Signal: -87},
+			{MCC: 250, MNC: 1, LAC: 818, CellID: 13049, Signal: -83},
+			{MCC: 250, MNC: 1, LAC: 6101, CellID: 4761, Signal: -76},
 		},
 	}
 
@@ -120,3 +120,12 @@ func Circle2Polygon(center [2]float64, radius float64) Polygon {
 	}
 	return NewPolygon(points...)
 }
+
+// Distance возвращает расстояние между точками в метрах.
+func Distance(p1, p2 Point) float64 {
+	lon1, lat1 := p1[0]*math.Pi/180, p1[1]*math.Pi/180
+	lon2, lat2 := p2[0]*math.Pi/180, p2[1]*math.Pi/180
+	sinLat, sinLon := math.Sin((lat2-lat1)/2), math.Sin((lon2-lon1)/2)
+	a := sinLat*sinLat + math.Cos(lat1)*math.Cos(lat2)*sinLon*sinLon
+	return 2 * earthRadius * math.Asin(math.Min(1, math.Sqrt(a)))
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"errors"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Geocode описывает сервис определения адреса по координатам.
+//
+// Для определения адреса используется локальный справочник, загруженный из
+// выгрузки GeoNames (населенные пункты, регионы и страны) и файлов адресов в
+// формате OpenAddresses, поэтому обращения к внешним сервисам не требуется.
+type Geocode struct {
+	AddressDistance  float64 // максимальное расстояние до адреса, м (по умолчанию 100)
+	LocalityDistance float64 // максимальное расстояние до населенного пункта, м (по умолчанию 30000)
+
+	coll *mgo.Collection // коллекция справочника
+}
+
+// виды объектов справочника
+const (
+	geoAddress  = "address"
+	geoLocality = "locality"
+	geoRegion   = "region"
+	geoCountry  = "country"
+)
+
+// geoPlace описывает объект справочника.
+type geoPlace struct {
+	ID         string `bson:"_id"`
+	Kind       string // вид объекта: address, locality, region, country
+	Name       string // название
+	Point      Point  // координаты
+	Country    string `bson:",omitempty"` // код страны ISO 3166-1
+	Admin1     string `bson:",omitempty"` // код региона GeoNames
+	Population int64  `bson:",omitempty"` // население
+
+	Street      string `bson:",omitempty"` // улица
+	HouseNumber string `bson:",omitempty"` // номер дома
+	Postcode    string `bson:",omitempty"` // почтовый индекс
+	City        string `bson:",omitempty"` // населенный пункт из адреса
+	Region      string `bson:",omitempty"` // регион из адреса
+}
+
+// GeocodeResponse описывает адрес, найденный по координатам.
+type GeocodeResponse struct {
+	Address     string  // улица и номер дома
+	Street      string  // улица
+	HouseNumber string  // номер дома
+	Postcode    string  // почтовый индекс
+	Locality    string  // населенный пункт
+	Region      string  // регион
+	Country     string  // код страны ISO 3166-1
+	CountryName string  // название страны
+	Distance    float64 // расстояние до найденного адреса, м
+}
+
+// Reverse возвращает ближайший адрес, населенный пункт, регион и страну для
+// указанных координат. Адрес и населенный пункт ищутся в пределах
+// AddressDistance и LocalityDistance соответственно, а регион и страна
+// определяются по ближайшему населенному пункту на любом расстоянии.
+func (g *Geocode) Reverse(p Point, resp *GeocodeResponse) error {
+	if g.coll == nil {
+		return errors.New("GEOCODE: service not initialized")
+	}
+	if p[0] < -180 || p[0] > 180 || p[1] < -90 || p[1] > 90 {
+		return errors.New("GEOCODE: bad point")
+	}
+	session := g.coll.Database.Session.Copy()
+	defer session.Close()
+	index := geoCollection{session.DB(g.coll.Database.Name).C(g.coll.Name)}
+	result, err := g.reverse(index, p)
+	if err != nil {
+		return err
+	}
+	*resp = *result
+	return nil
+}
+
+// geoIndex описывает поиск объектов справочника.
+type geoIndex interface {
+	// nearest возвращает ближайший объект указанного вида в пределах
+	// maxDistance (без ограничения, если оно не задано) или nil.
+	nearest(kind string, p Point, maxDistance float64) (*geoPlace, error)
+	// find возвращает объект указанного вида по коду страны и региона или
+	// nil. Пустой код региона не учитывается.
+	find(kind, country, admin1 string) (*geoPlace, error)
+}
+
+// reverse определяет адрес по координатам с помощью указанного справочника.
+func (g *Geocode) reverse(index geoIndex, p Point) (*GeocodeResponse, error) {
+	var result GeocodeResponse
+	address, err := index.nearest(geoAddress, p, g.AddressDistance)
+	if err != nil {
+		return nil, err
+	}
+	if address != nil {
+		result.Street = address.Street
+		result.HouseNumber = address.HouseNumber
+		result.Postcode = address.Postcode
+		result.Address = address.Street
+		if address.HouseNumber != "" {
+			result.Address += ", " + address.HouseNumber
+		}
+		result.Locality = address.City
+		result.Region = address.Region
+		result.Distance = Distance(p, address.Point)
+	}
+	locality, err := index.nearest(geoLocality, p, g.LocalityDistance)
+	if err != nil {
+		return nil, err
+	}
+	// название из адреса точнее ближайшего населенного пункта
+	if locality != nil && result.Locality == "" {
+		result.Locality = locality.Name
+	}
+	// регион и страна определяются и для точек вдали от населенных пунктов:
+	// по ближайшему из них или по ближайшему региону
+	area := locality
+	if area == nil {
+		if area, err = index.nearest(geoLocality, p, 0); err != nil {
+			return nil, err
+		}
+	}
+	if area == nil {
+		if area, err = index.nearest(geoRegion, p, 0); err != nil {
+			return nil, err
+		}
+	}
+	if area == nil {
+		if address == nil {
+			return nil, errors.New("GEOCODE: nothing found")
+		}
+		return &result, nil
+	}
+	result.Country = area.Country
+	if result.Region == "" && area.Admin1 != "" {
+		region := area
+		if area.Kind != geoRegion {
+			if region, err = index.find(geoRegion, area.Country, area.Admin1); err != nil {
+				return nil, err
+			}
+		}
+		if region != nil {
+			result.Region = region.Name
+		}
+	}
+	country, err := index.find(geoCountry, area.Country, "")
+	if err != nil {
+		return nil, err
+	}
+	if country != nil {
+		result.CountryName = country.Name
+	}
+	return &result, nil
+}
+
+// ensureIndex создает индексы справочника для поиска ближайших объектов и
+// регионов по коду.
+func (g *Geocode) ensureIndex() error {
+	if err := g.coll.EnsureIndexKey("kind", "$2dsphere:point"); err != nil {
+		return err
+	}
+	return g.coll.EnsureIndexKey("kind", "country", "admin1")
+}
+
+// geoCollection ищет объекты справочника в базе данных.
+type geoCollection struct {
+	coll *mgo.Collection
+}
+
+// nearest возвращает ближайший к точке объект справочника указанного вида.
+func (c geoCollection) nearest(kind string, p Point,
+	maxDistance float64) (*geoPlace, error) {
+	near := bson.D{{Name: "$nearSphere", Value: p}}
+	if maxDistance > 0 {
+		near = append(near, bson.DocElem{Name: "$maxDistance", Value: maxDistance})
+	}
+	return c.one(bson.M{"kind": kind, "point": near})
+}
+
+// find возвращает объект справочника по коду страны и региона.
+func (c geoCollection) find(kind, country, admin1 string) (*geoPlace, error) {
+	query := bson.M{"kind": kind, "country": country}
+	if admin1 != "" {
+		query["admin1"] = admin1
+	}
+	return c.one(query)
+}
+
+// one возвращает первый объект справочника, удовлетворяющий запросу, или nil.
+func (c geoCollection) one(query bson.M) (*geoPlace, error) {
+	place := new(geoPlace)
+	err := c.coll.Find(query).One(place)
+	if err == mgo.ErrNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return place, nil
+}
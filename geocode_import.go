@@ -0,0 +1,206 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// максимальная длина строки выгрузки GeoNames
+const geoNamesMaxLine = 1 << 20
+
+// importGazetteer загружает в справочник объекты из выгрузки GeoNames
+// (allCountries.txt или выгрузки по стране) или из файла адресов в формате
+// OpenAddresses и возвращает количество загруженных объектов. Формат
+// определяется по первой строке: файл OpenAddresses содержит заголовок с
+// колонками LON и LAT. Строки с некорректными данными пропускаются.
+func (g *Geocode) importGazetteer(r io.Reader) (int, error) {
+	session := g.coll.Database.Session.Copy()
+	defer session.Close()
+	coll := session.DB(g.coll.Database.Name).C(g.coll.Name)
+	var (
+		bulk    = coll.Bulk()
+		pending int
+		count   int
+	)
+	save := func(place *geoPlace) error {
+		bulk.Upsert(bson.M{"_id": place.ID}, place)
+		if pending++; pending == cellsImportBatch {
+			if _, err := bulk.Run(); err != nil {
+				return err
+			}
+			count += pending
+			bulk, pending = coll.Bulk(), 0
+		}
+		return nil
+	}
+	br := bufio.NewReaderSize(r, geoNamesMaxLine)
+	header, err := br.ReadString('\n')
+	if err != nil && err != io.EOF {
+		return 0, err
+	}
+	if columns, ok := openAddressesColumns(header); ok {
+		reader := csv.NewReader(br)
+		reader.FieldsPerRecord = -1
+		reader.ReuseRecord = true
+		for {
+			record, err := reader.Read()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return count, err
+			}
+			if place, ok := parseAddress(record, columns); ok {
+				if err := save(place); err != nil {
+					return count, err
+				}
+			}
+		}
+	} else {
+		scanner := bufio.NewScanner(io.MultiReader(strings.NewReader(header), br))
+		scanner.Buffer(make([]byte, 0, 64<<10), geoNamesMaxLine)
+		for scanner.Scan() {
+			if place, ok := parseGeoNames(scanner.Text()); ok {
+				if err := save(place); err != nil {
+					return count, err
+				}
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			return count, err
+		}
+	}
+	if pending > 0 {
+		if _, err := bulk.Run(); err != nil {
+			return count, err
+		}
+		count += pending
+	}
+	return count, nil
+}
+
+// openAddressesColumns разбирает заголовок файла OpenAddresses и возвращает
+// номера колонок по их названиям в нижнем регистре.
+func openAddressesColumns(header string) (map[string]int, bool) {
+	record, err := csv.NewReader(strings.NewReader(header)).Read()
+	if err != nil {
+		return nil, false
+	}
+	columns := make(map[string]int)
+	for i, name := range record {
+		columns[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+	_, lon := columns["lon"]
+	_, lat := columns["lat"]
+	return columns, lon && lat
+}
+
+// parseAddress разбирает адрес из строки файла OpenAddresses.
+func parseAddress(record []string, columns map[string]int) (*geoPlace, bool) {
+	field := func(name string) string {
+		if i, ok := columns[name]; ok && i < len(record) {
+			return strings.TrimSpace(record[i])
+		}
+		return ""
+	}
+	lon, err := strconv.ParseFloat(field("lon"), 64)
+	if err != nil || lon < -180 || lon > 180 {
+		return nil, false
+	}
+	lat, err := strconv.ParseFloat(field("lat"), 64)
+	if err != nil || lat < -90 || lat > 90 {
+		return nil, false
+	}
+	place := &geoPlace{
+		Kind:        geoAddress,
+		Point:       NewPoint(lon, lat),
+		Street:      field("street"),
+		HouseNumber: field("number"),
+		Postcode:    field("postcode"),
+		City:        field("city"),
+		Region:      field("region"),
+	}
+	if place.Street == "" {
+		return nil, false
+	}
+	place.Name = place.Street
+	if place.HouseNumber != "" {
+		place.Name += ", " + place.HouseNumber
+	}
+	// идентификатор адреса не всегда заполнен, поэтому при его отсутствии
+	// используются координаты и адрес
+	id := field("hash")
+	if id == "" {
+		id = field("id")
+	}
+	if id == "" {
+		id = fmt.Sprintf("%.6f,%.6f,%s", lon, lat, place.Name)
+	}
+	place.ID = "oa:" + id
+	return place, true
+}
+
+// parseGeoNames разбирает строку выгрузки GeoNames. Загружаются только
+// населенные пункты (класс P), регионы (ADM1) и страны (PCL*).
+func parseGeoNames(line string) (*geoPlace, bool) {
+	fields := strings.Split(line, "\t")
+	if len(fields) < 15 {
+		return nil, false
+	}
+	place := &geoPlace{
+		ID:      "geonames:" + fields[0],
+		Name:    fields[1],
+		Country: fields[8],
+		Admin1:  fields[10],
+	}
+	switch class, code := fields[6], fields[7]; {
+	case class == "P":
+		place.Kind = geoLocality
+	case class == "A" && code == "ADM1":
+		place.Kind = geoRegion
+	case class == "A" && strings.HasPrefix(code, "PCL"):
+		place.Kind = geoCountry
+		place.Admin1 = ""
+	default:
+		return nil, false
+	}
+	lat, err := strconv.ParseFloat(fields[4], 64)
+	if err != nil || lat < -90 || lat > 90 {
+		return nil, false
+	}
+	lon, err := strconv.ParseFloat(fields[5], 64)
+	if err != nil || lon < -180 || lon > 180 {
+		return nil, false
+	}
+	place.Point = NewPoint(lon, lat)
+	place.Population, _ = strconv.ParseInt(fields[14], 10, 64)
+	return place, true
+}
+
+// importGazetteerFile загружает в справочник объекты из файла. Файлы с
+// расширением .gz распаковываются.
+func (g *Geocode) importGazetteerFile(filename string) (int, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	var r io.Reader = file
+	if strings.HasSuffix(filename, ".gz") {
+		gz, err := gzip.NewReader(file)
+		if err != nil {
+			return 0, err
+		}
+		defer gz.Close()
+		r = gz
+	}
+	return g.importGazetteer(r)
+}
@@ -0,0 +1,105 @@
+package main
+
+import "testing"
+
+func TestParseGeoNames(t *testing.T) {
+	line := "524901\tMoscow\tMoscow\tMoskva,Москва\t55.75222\t37.61556\tP\tPPLC\tRU\t\t48\t\t\t\t10381222\t\t144\tEurope/Moscow\t2022-12-10"
+	place, ok := parseGeoNames(line)
+	if !ok {
+		t.Fatal("locality not parsed")
+	}
+	if place.ID != "geonames:524901" || place.Kind != geoLocality ||
+		place.Name != "Moscow" || place.Country != "RU" || place.Admin1 != "48" ||
+		place.Point != NewPoint(37.61556, 55.75222) || place.Population != 10381222 {
+		t.Errorf("bad locality: %+v", place)
+	}
+	line = "2017370\tRussia\tRussia\t\t60\t100\tA\tPCLI\tRU\t\t00\t\t\t\t140702000\t\t\tEurope/Moscow\t2022-08-08"
+	if place, ok := parseGeoNames(line); !ok || place.Kind != geoCountry ||
+		place.Admin1 != "" {
+		t.Errorf("bad country: %+v", place)
+	}
+	// реки и другие объекты не загружаются
+	line = "123\tMoskva\tMoskva\t\t55.7\t37.6\tH\tSTM\tRU\t\t48\t\t\t\t0\t\t\t\t"
+	if _, ok := parseGeoNames(line); ok {
+		t.Error("stream parsed")
+	}
+}
+
+func TestParseAddress(t *testing.T) {
+	columns, ok := openAddressesColumns("LON,LAT,NUMBER,STREET,UNIT,CITY,DISTRICT,REGION,POSTCODE,ID,HASH\n")
+	if !ok {
+		t.Fatal("header not detected")
+	}
+	record := []string{"37.5894", "55.7662", "12", "Тверская улица", "", "Москва",
+		"", "", "125009", "", "ab12cd"}
+	place, ok := parseAddress(record, columns)
+	if !ok {
+		t.Fatal("address not parsed")
+	}
+	if place.ID != "oa:ab12cd" || place.Kind != geoAddress ||
+		place.Name != "Тверская улица, 12" || place.City != "Москва" ||
+		place.Postcode != "125009" || place.Point != NewPoint(37.5894, 55.7662) {
+		t.Errorf("bad address: %+v", place)
+	}
+	if _, ok := openAddressesColumns("524901\tMoscow\tMoscow\n"); ok {
+		t.Error("GeoNames line detected as header")
+	}
+}
+
+// geoPlaces описывает справочник в памяти для проверки поиска.
+type geoPlaces []geoPlace
+
+func (places geoPlaces) nearest(kind string, p Point,
+	maxDistance float64) (*geoPlace, error) {
+	var found *geoPlace
+	for i, place := range places {
+		distance := Distance(p, place.Point)
+		if place.Kind != kind || (maxDistance > 0 && distance > maxDistance) {
+			continue
+		}
+		if found == nil || distance < Distance(p, found.Point) {
+			found = &places[i]
+		}
+	}
+	return found, nil
+}
+
+func (places geoPlaces) find(kind, country, admin1 string) (*geoPlace, error) {
+	for i, place := range places {
+		if place.Kind == kind && place.Country == country &&
+			(admin1 == "" || place.Admin1 == admin1) {
+			return &places[i], nil
+		}
+	}
+	return nil, nil
+}
+
+func TestGeocodeReverse(t *testing.T) {
+	g := &Geocode{AddressDistance: 100, LocalityDistance: 30000}
+	index := geoPlaces{
+		{Kind: geoAddress, Point: NewPoint(38.5, 56), Street: "Лесная", HouseNumber: "1"},
+		{Kind: geoLocality, Name: "Moscow", Point: NewPoint(37.6, 55.75), Country: "RU", Admin1: "48"},
+		{Kind: geoRegion, Name: "Moscow", Point: NewPoint(37.6, 55.75), Country: "RU", Admin1: "48"},
+		{Kind: geoCountry, Name: "Russia", Point: NewPoint(100, 60), Country: "RU"},
+	}
+	// адрес найден, а населенных пунктов ближе LocalityDistance нет
+	resp, err := g.reverse(index, NewPoint(38.5, 56))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Address != "Лесная, 1" || resp.Locality != "" || resp.Region != "Moscow" ||
+		resp.Country != "RU" || resp.CountryName != "Russia" {
+		t.Errorf("bad address without locality: %+v", resp)
+	}
+	// нет ни адреса, ни населенного пункта поблизости
+	resp, err = g.reverse(index, NewPoint(40, 57))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Address != "" || resp.Country != "RU" || resp.Region != "Moscow" {
+		t.Errorf("bad remote point: %+v", resp)
+	}
+	if _, err := g.reverse(geoPlaces{}, NewPoint(40, 57)); err == nil {
+		t.Error("empty gazetteer returned result")
+	}
+}
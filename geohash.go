@@ -0,0 +1,75 @@
+package main
+
+import (
+	"math"
+	"strings"
+)
+
+// geohashBase32 содержит алфавит для кодирования geohash.
+const geohashBase32 = "0123456789bcdefghjkmnpqrstuvwxyz"
+
+// Geohash возвращает geohash указанной длины для точки.
+func Geohash(p Point, precision int) string {
+	lonRange := [2]float64{-180, 180}
+	latRange := [2]float64{-90, 90}
+	hash := make([]byte, 0, precision)
+	var bits, ch int
+	even := true // четные биты кодируют долготу, нечетные — широту
+	for len(hash) < precision {
+		rng, value := &latRange, p[1]
+		if even {
+			rng, value = &lonRange, p[0]
+		}
+		mid := (rng[0] + rng[1]) / 2
+		ch <<= 1
+		if value >= mid {
+			ch |= 1
+			rng[0] = mid
+		} else {
+			rng[1] = mid
+		}
+		even = !even
+		if bits++; bits == 5 {
+			hash = append(hash, geohashBase32[ch])
+			bits, ch = 0, 0
+		}
+	}
+	return string(hash)
+}
+
+// GeohashCenter возвращает координаты центра ячейки geohash.
+func GeohashCenter(hash string) Point {
+	lonRange := [2]float64{-180, 180}
+	latRange := [2]float64{-90, 90}
+	even := true
+	for i := 0; i < len(hash); i++ {
+		ch := strings.IndexByte(geohashBase32, hash[i])
+		for mask := 16; mask > 0; mask >>= 1 {
+			rng := &latRange
+			if even {
+				rng = &lonRange
+			}
+			mid := (rng[0] + rng[1]) / 2
+			if ch&mask != 0 {
+				rng[0] = mid
+			} else {
+				rng[1] = mid
+			}
+			even = !even
+		}
+	}
+	return Point{(lonRange[0] + lonRange[1]) / 2, (latRange[0] + latRange[1]) / 2}
+}
+
+// geohashPrecision возвращает минимальную длину geohash, при которой размер
+// ячейки по широте не превышает указанного расстояния в метрах.
+func geohashPrecision(distance float64) int {
+	for precision := 1; precision < 12; precision++ {
+		latBits := precision * 5 / 2 // количество бит, кодирующих широту
+		height := math.Pi * earthRadius / math.Pow(2, float64(latBits))
+		if height <= distance {
+			return precision
+		}
+	}
+	return 12
+}
@@ -0,0 +1,20 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestGeohash(t *testing.T) {
+	point := NewPoint(-5.603, 42.605)
+	if hash := Geohash(point, 5); hash != "ezs42" {
+		t.Errorf("bad geohash: %s", hash)
+	}
+	center := GeohashCenter("ezs42")
+	if math.Abs(center[0]-point[0]) > 0.03 || math.Abs(center[1]-point[1]) > 0.03 {
+		t.Errorf("bad geohash center: %v", center)
+	}
+	if precision := geohashPrecision(10000); precision != 5 {
+		t.Errorf("bad geohash precision: %d", precision)
+	}
+}
@@ -2,36 +2,215 @@ package main
 
 import (
 	"errors"
-
-	"github.com/mdigger/geolocate"
+	"fmt"
+	"log"
+	"strings"
+	"sync/atomic"
+	"time"
 )
 
 // LBS сервис определения координат по данным сотовых вышек и Wi-Fi.
+//
+// Внешние сервисы геолокации перебираются в порядке их описания в Providers:
+// если сервис вернул ошибку или пустой ответ, то запрос передается следующему.
+// Сервис, заданный в Type и Token, используется первым. В режиме consensus
+// запрос передается всем сервисам одновременно, а их ответы объединяются.
 type LBS struct {
-	Type  string // название сервиса (Google, Mozilla, Yandex)
-	Token string // токен для пользования сервисом
+	Type            string           // название сервиса (Google, Mozilla, Yandex)
+	Token           string           // токен для пользования сервисом
+	Providers       []LBSProvider    // список сервисов в порядке использования
+	Mode            string           // режим работы: fallback (по умолчанию) или consensus
+	Answers         bool             // возвращать ответы отдельных сервисов в режиме consensus
+	MaxResponseSize int64            // максимальный размер ответа сервиса в байтах
+	Cache           *LBSCache        // настройки кеширования ответов
+	Plausibility    *LBSPlausibility // настройки проверки правдоподобности
+	Calibration     *LBSCalibration  // настройки калибровки погрешности ответов
+	MinWifi         int              // минимальное количество точек доступа (по умолчанию 2)
+	Parallelism     int              // количество одновременно обрабатываемых запросов пакета (по умолчанию 4)
 
-	locator geolocate.Locator // инициализированный сервис гео-локации
+	providers []*lbsProvider // инициализированные сервисы гео-локации
+	cells     *cellsDB       // база данных вышек
+	usage     *Usage         // учет запросов к внешним сервисам
 }
 
 // LBSResponse описывает ответ сервиса.
 type LBSResponse struct {
 	Point    Point   // координаты точки
 	Accuracy float64 // точность вычисления (погрешность)
+	Provider string  // название сервиса, вычислившего координаты
+
+	Answers  []LBSResponse // ответы отдельных сервисов
+	Rejected bool          // ответ отброшен при объединении
+
+	Suspicious bool    // неправдоподобное перемещение устройства
+	Speed      float64 // скорость перемещения с прошлых координат, м/с
+	Excluded   string  // исключенная из запроса вышка или точка доступа
+
+	Dropped  map[string]int // количество исключенных точек доступа по причинам
+	Reported float64        // погрешность, заявленная сервисом, до калибровки
+}
+
+// init инициализирует внешние сервисы геолокации.
+func (s *LBS) init() error {
+	configs := s.Providers
+	if s.Type != "" {
+		configs = append([]LBSProvider{
+			{Type: s.Type, Token: s.Token, Timeout: lbsTimeout},
+		}, configs...)
+	}
+	if len(configs) == 0 {
+		return errors.New("LBS: no providers")
+	}
+	switch s.Mode {
+	case "", "fallback", "consensus":
+	default:
+		return fmt.Errorf("LBS: unknown mode %s", s.Mode)
+	}
+	s.providers = make([]*lbsProvider, len(configs))
+	for i, config := range configs {
+		provider, err := newLBSProvider(config, s.MaxResponseSize, s.cells)
+		if err != nil {
+			return err
+		}
+		s.providers[i] = provider
+	}
+	return nil
 }
 
 // Get передает параметры с данными LBS на внешний сервер геолокации и
 // возвращает полученные от сервера данные.
-func (s *LBS) Get(req geolocate.Request, resp *LBSResponse) error {
-	if s.locator == nil {
+func (s *LBS) Get(req LBSRequest, resp *LBSResponse) error {
+	if len(s.providers) == 0 {
 		return errors.New("LBS: service not initialized")
 	}
-	// осуществляем запрос к внешнему сервису геолокации
-	respData, err := s.locator.Get(req)
-	if err != nil {
+	if err := req.normalize(); err != nil {
 		return err
 	}
-	resp.Point = NewPoint(respData.Location.Lon, respData.Location.Lat)
-	resp.Accuracy = respData.Accuracy
+	// проверяем, что ответ для таких же данных уже есть в кеше
+	query := s.query(req)
+	cached, ok := s.Cache.get(req)
+	if ok {
+		*resp = *cached
+	} else if err := s.locate(query, resp); err != nil {
+		return err
+	}
+	if req.Time.IsZero() {
+		req.Time = time.Now()
+	}
+	// сохраняем ответы для сравнения с координатами GPS, а координаты GPS из
+	// запроса сравниваем с сохраненными ранее ответами
+	if s.Calibration != nil && req.Device != "" {
+		// ошибка калибровки не должна мешать определению координат
+		if gps := req.GPS; gps != nil && !gps.Time.IsZero() {
+			err := s.Calibration.truth(req.Device, gps.Point, gps.Accuracy, gps.Time)
+			if err != nil {
+				log.Println("LBS: calibration error:", err)
+			}
+		}
+		if !ok {
+			list := resp.Answers
+			if len(list) == 0 {
+				list = []LBSResponse{*resp}
+			}
+			s.Calibration.record(req.Device, req.Time, list)
+		}
+	}
+	if !s.Answers {
+		resp.Answers = nil
+	}
+	// проверяем правдоподобность ответа по истории перемещений устройства
+	if s.Plausibility != nil && req.Device != "" {
+		if err := s.plausible(req, resp); err != nil {
+			return err
+		}
+	}
+	if !ok && !resp.Suspicious {
+		s.Cache.put(req, resp)
+	}
+	// исключенные точки доступа имеют значение, только если запрос
+	// действительно передавался внешним сервисам
+	if atomic.LoadInt32(&query.sent) > 0 {
+		resp.Dropped = query.dropped
+	}
 	return nil
 }
+
+// lbsQuery описывает запрос к сервисам геолокации. Точки доступа, которые не
+// должны передаваться внешним сервисам, исключаются только из запроса к ним,
+// а локальной базе данных вышек доступны все.
+type lbsQuery struct {
+	local    LBSRequest     // полный запрос для локальной базы данных вышек
+	upstream LBSRequest     // запрос для внешних сервисов
+	dropped  map[string]int // количество исключенных точек доступа по причинам
+	sent     int32          // количество отправленных внешним сервисам запросов
+}
+
+// query возвращает запрос к сервисам геолокации.
+func (s *LBS) query(req LBSRequest) *lbsQuery {
+	query := &lbsQuery{local: req, upstream: req}
+	query.dropped = filterWifi(&query.upstream, s.MinWifi)
+	return query
+}
+
+// locate запрашивает координаты у сервисов геолокации в соответствии с
+// режимом работы.
+func (s *LBS) locate(query *lbsQuery, resp *LBSResponse) error {
+	if s.Mode == "consensus" {
+		return s.consensus(query, resp)
+	}
+	return s.fallback(query, resp)
+}
+
+// fallback запрашивает координаты у сервисов геолокации по очереди до первого
+// успешного ответа.
+func (s *LBS) fallback(query *lbsQuery, resp *LBSResponse) error {
+	var (
+		errs    []string
+		lastErr error
+	)
+	for _, provider := range s.providers {
+		respData, err := s.request(provider, query)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %v", provider.name, err))
+			lastErr = err
+			continue
+		}
+		*resp = *respData
+		return nil
+	}
+	if len(errs) == 1 {
+		return lastErr
+	}
+	return fmt.Errorf("LBS: all providers failed: %s", strings.Join(errs, "; "))
+}
+
+// request запрашивает координаты у сервиса геолокации с учетом ограничений на
+// количество запросов к нему. Пустой ответ считается ошибкой.
+func (s *LBS) request(provider *lbsProvider, query *lbsQuery) (*LBSResponse, error) {
+	// локальная база данных вышек в учете запросов и исключении точек
+	// доступа не участвует
+	req := query.local
+	if provider.cells == nil {
+		req = query.upstream
+		if len(req.Cells) == 0 && len(req.Wifi) == 0 && !req.ConsiderIP {
+			return nil, errors.New("LBS: no cells or access points after filtering")
+		}
+		if err := s.usage.allow(provider.name, provider.token); err != nil {
+			return nil, fmt.Errorf("LBS: %v", err)
+		}
+	}
+	// запрос учитывается, только если он действительно отправлен сервису
+	resp, err := provider.Get(req, func() {
+		atomic.AddInt32(&query.sent, 1)
+		s.usage.record(provider.name, provider.token, req.Device)
+	})
+	if err == nil && resp.Accuracy <= 0 {
+		err = errors.New("LBS: empty result")
+	}
+	// погрешность исправляется до объединения ответов, чтобы их веса
+	// соответствовали реальной точности сервисов
+	if err == nil && s.Calibration != nil && s.Calibration.Rescale {
+		s.Calibration.rescale(resp)
+	}
+	return resp, err
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"errors"
+	"sort"
+	"sync"
+)
+
+// максимальное количество запросов в пакете
+const lbsBatchMax = 1000
+
+// LBSBatchResult описывает результат обработки одного запроса из пакета.
+type LBSBatchResult struct {
+	Response *LBSResponse // ответ, если запрос обработан успешно
+	Error    string       // описание ошибки
+}
+
+// GetBatch обрабатывает пакет запросов и возвращает результаты в том же
+// порядке. Запросы обрабатываются параллельно, но не более Parallelism
+// одновременно. Если включена проверка правдоподобности, то запросы одного
+// устройства обрабатываются последовательно в порядке времени измерения,
+// чтобы каждый следующий ответ сравнивался с предыдущим.
+func (s *LBS) GetBatch(reqs []LBSRequest, results *[]LBSBatchResult) error {
+	if len(s.providers) == 0 {
+		return errors.New("LBS: service not initialized")
+	}
+	if len(reqs) > lbsBatchMax {
+		return errors.New("LBS: batch too large")
+	}
+	// разбиваем запросы на группы, которые обрабатываются последовательно
+	var groups [][]int
+	devices := make(map[string]int)
+	for i, req := range reqs {
+		if s.Plausibility == nil || req.Device == "" {
+			groups = append(groups, []int{i})
+			continue
+		}
+		group, ok := devices[req.Device]
+		if !ok {
+			group = len(groups)
+			devices[req.Device] = group
+			groups = append(groups, nil)
+		}
+		groups[group] = append(groups[group], i)
+	}
+	for _, group := range groups {
+		sort.SliceStable(group, func(i, j int) bool {
+			return reqs[group[i]].Time.Before(reqs[group[j]].Time)
+		})
+	}
+	list := make([]LBSBatchResult, len(reqs))
+	queue := make(chan []int)
+	var wg sync.WaitGroup
+	// без хотя бы одного обработчика отправка в очередь заблокируется навсегда
+	workers := s.Parallelism
+	if workers < 1 {
+		workers = 1
+	}
+	for i := 0; i < workers && i < len(groups); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for group := range queue {
+				for _, index := range group {
+					resp := new(LBSResponse)
+					if err := s.Get(reqs[index], resp); err != nil {
+						list[index].Error = err.Error()
+					} else {
+						list[index].Response = resp
+					}
+				}
+			}
+		}()
+	}
+	for _, group := range groups {
+		queue <- group
+	}
+	close(queue)
+	wg.Wait()
+	*results = list
+	return nil
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"log"
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// максимальное количество проверяемых ответов из кеша
+const lbsCacheCandidates = 20
+
+// LBSCache описывает настройки кеширования ответов сервиса LBS.
+//
+// Ответ из кеша используется, если набор сотовых вышек и точек доступа Wi-Fi
+// в запросе почти совпадает с набором, для которого был получен ответ, а
+// уровни сигналов изменились незначительно. Так стоящее на месте устройство не
+// вызывает повторных платных запросов к внешним сервисам.
+type LBSCache struct {
+	Time       time.Duration // время хранения ответов (по умолчанию 1 час)
+	Similarity float64       // минимальная доля общих вышек и точек доступа (по умолчанию 0.8)
+	Signal     float64       // допустимое среднее изменение уровня сигнала в дБм (по умолчанию 10)
+
+	coll   *mgo.Collection // коллекция с ответами
+	mu     sync.Mutex      // блокировка доступа к статистике
+	hits   int64           // количество найденных в кеше ответов
+	misses int64           // количество ненайденных в кеше ответов
+}
+
+// LBSCacheStats описывает статистику использования кеша ответов LBS.
+type LBSCacheStats struct {
+	Hits    int64   // количество найденных в кеше ответов
+	Misses  int64   // количество ненайденных в кеше ответов
+	HitRate float64 // доля найденных в кеше ответов
+}
+
+// lbsFingerprint описывает нормализованный набор сотовых вышек и точек
+// доступа Wi-Fi с уровнями их сигналов.
+type lbsFingerprint struct {
+	Cells   []string         // идентификаторы вышек
+	Wifi    []string         // MAC-адреса точек доступа
+	Signals map[string]int16 // уровни сигналов по идентификаторам
+}
+
+// newLBSFingerprint возвращает нормализованный набор вышек и точек доступа из
+// запроса. Идентификаторы сортируются.
+func newLBSFingerprint(req LBSRequest) lbsFingerprint {
+	fp := lbsFingerprint{Signals: make(map[string]int16)}
+	for _, cell := range req.Cells {
+		id := cell.key()
+		if _, ok := fp.Signals[id]; !ok {
+			fp.Cells = append(fp.Cells, id)
+		}
+		fp.Signals[id] = cell.Signal
+	}
+	for _, wifi := range req.Wifi {
+		if _, ok := fp.Signals[wifi.MAC]; !ok {
+			fp.Wifi = append(fp.Wifi, wifi.MAC)
+		}
+		fp.Signals[wifi.MAC] = wifi.Signal
+	}
+	sort.Strings(fp.Cells)
+	sort.Strings(fp.Wifi)
+	return fp
+}
+
+// match возвращает долю общих вышек и точек доступа в двух наборах и среднее
+// изменение уровня сигнала для них. Уровень сигнала учитывается, только если
+// он известен в обоих наборах.
+func (fp lbsFingerprint) match(other lbsFingerprint) (similarity, signal float64) {
+	var common, total, measured int
+	for id, level := range fp.Signals {
+		otherLevel, ok := other.Signals[id]
+		if !ok {
+			continue
+		}
+		common++
+		if level != 0 && otherLevel != 0 {
+			signal += math.Abs(float64(level) - float64(otherLevel))
+			measured++
+		}
+	}
+	total = len(fp.Signals) + len(other.Signals) - common
+	if total == 0 {
+		return 0, 0
+	}
+	if measured > 0 {
+		signal /= float64(measured)
+	}
+	return float64(common) / float64(total), signal
+}
+
+// get возвращает ответ из кеша для запроса с похожим набором вышек и точек
+// доступа.
+func (c *LBSCache) get(req LBSRequest) (*LBSResponse, bool) {
+	if c == nil {
+		return nil, false
+	}
+	fp := newLBSFingerprint(req)
+	if len(fp.Signals) == 0 {
+		return nil, false
+	}
+	session := c.coll.Database.Session.Copy()
+	defer session.Close()
+	coll := session.DB(c.coll.Database.Name).C(c.coll.Name)
+	var or []bson.M
+	if len(fp.Cells) > 0 {
+		or = append(or, bson.M{"fingerprint.cells": bson.M{"$in": fp.Cells}})
+	}
+	if len(fp.Wifi) > 0 {
+		or = append(or, bson.M{"fingerprint.wifi": bson.M{"$in": fp.Wifi}})
+	}
+	var candidates []struct {
+		Fingerprint lbsFingerprint
+		Response    LBSResponse
+	}
+	err := coll.Find(bson.M{"$or": or}).Sort("-time").
+		Limit(lbsCacheCandidates).All(&candidates)
+	if err != nil {
+		log.Println("LBS: cache error:", err)
+	}
+	var (
+		best           *LBSResponse
+		bestSimilarity float64
+	)
+	for i, candidate := range candidates {
+		similarity, signal := fp.match(candidate.Fingerprint)
+		if similarity >= c.Similarity && signal <= c.Signal &&
+			similarity > bestSimilarity {
+			best, bestSimilarity = &candidates[i].Response, similarity
+		}
+	}
+	c.mu.Lock()
+	if best != nil {
+		c.hits++
+	} else {
+		c.misses++
+	}
+	c.mu.Unlock()
+	return best, best != nil
+}
+
+// put сохраняет ответ в кеше. Ответы отдельных сервисов и сведения об
+// исключенных точках доступа не сохраняются.
+func (c *LBSCache) put(req LBSRequest, resp *LBSResponse) {
+	if c == nil {
+		return
+	}
+	fp := newLBSFingerprint(req)
+	if len(fp.Signals) == 0 {
+		return
+	}
+	response := *resp
+	response.Answers, response.Dropped = nil, nil
+	session := c.coll.Database.Session.Copy()
+	defer session.Close()
+	coll := session.DB(c.coll.Database.Name).C(c.coll.Name)
+	err := coll.Insert(struct {
+		Fingerprint lbsFingerprint
+		Response    LBSResponse
+		Time        time.Time
+	}{fp, response, time.Now()})
+	if err != nil {
+		log.Println("LBS: cache error:", err)
+	}
+}
+
+// stats возвращает статистику использования кеша и, если указано, сбрасывает
+// счетчики.
+func (c *LBSCache) stats(reset bool) LBSCacheStats {
+	if c == nil {
+		return LBSCacheStats{}
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	stats := LBSCacheStats{Hits: c.hits, Misses: c.misses}
+	if total := c.hits + c.misses; total > 0 {
+		stats.HitRate = float64(c.hits) / float64(total)
+	}
+	if reset {
+		c.hits, c.misses = 0, 0
+	}
+	return stats
+}
+
+// CacheStats возвращает статистику использования кеша ответов. Если reset
+// равен true, то счетчики сбрасываются.
+func (s *LBS) CacheStats(reset bool, stats *LBSCacheStats) error {
+	*stats = s.Cache.stats(reset)
+	return nil
+}
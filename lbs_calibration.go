@@ -0,0 +1,310 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// максимальное количество последних ошибок, по которым вычисляется
+// коэффициент калибровки
+const lbsCalibrationSamples = 1000
+
+// LBSCalibration описывает настройки калибровки погрешности ответов сервисов
+// геолокации.
+//
+// Ответы сервисов для устройства сохраняются и сравниваются с координатами
+// GPS, которые устройство передает позже: через Observe или в подсказке GPS
+// следующего запроса. Ошибки накапливаются по сервисам и регионам (ячейкам
+// geohash), а коэффициент калибровки вычисляется как процентиль отношения
+// фактической ошибки к заявленной погрешности. При включенном Rescale
+// погрешность ответов умножается на этот коэффициент, так что заданная доля
+// реальных координат попадает в возвращаемый радиус.
+type LBSCalibration struct {
+	Window      time.Duration // максимальная разница времени ответа и координат GPS (по умолчанию 1 минута)
+	MaxAge      time.Duration // время хранения ошибок (по умолчанию 30 дней)
+	MaxAccuracy float64       // максимальная погрешность координат GPS, м (по умолчанию 50)
+	Precision   int           // длина geohash региона (по умолчанию 3)
+	MinSamples  int           // минимальное количество ошибок для калибровки (по умолчанию 50)
+	Percentile  float64       // доля координат внутри погрешности (по умолчанию 0.68)
+	Interval    time.Duration // интервал пересчета коэффициентов (по умолчанию 1 час)
+	Rescale     bool          // изменять погрешность ответов по коэффициентам
+
+	answers *mgo.Collection     // ответы, ожидающие координат GPS
+	coll    *mgo.Collection     // ошибки ответов
+	mu      sync.Mutex          // блокировка доступа к коэффициентам
+	scales  map[string]lbsScale // коэффициенты по сервисам и регионам
+}
+
+// lbsScale описывает вычисленный коэффициент калибровки.
+type lbsScale struct {
+	value float64   // коэффициент или 0, если ошибок недостаточно
+	time  time.Time // время вычисления
+}
+
+// lbsAnswer описывает сохраненный ответ сервиса геолокации.
+type lbsAnswer struct {
+	ID       bson.ObjectId `bson:"_id"`
+	Device   string        // идентификатор устройства
+	Time     time.Time     // время измерения
+	Created  time.Time     // время сохранения ответа
+	Provider string        // название сервиса
+	Point    Point         // координаты ответа
+	Accuracy float64       // погрешность, заявленная сервисом
+}
+
+// lbsError описывает ошибку ответа сервиса геолокации.
+type lbsError struct {
+	Provider string    // название сервиса
+	Region   string    // geohash региона по координатам GPS
+	Error    float64   // расстояние до координат GPS, м
+	Accuracy float64   // погрешность, заявленная сервисом
+	Ratio    float64   // отношение ошибки к погрешности
+	Time     time.Time // время измерения
+}
+
+// LBSCalibrationRequest описывает фильтр статистики калибровки.
+type LBSCalibrationRequest struct {
+	Provider string // название сервиса
+	Region   string // geohash региона; пустой — статистика по сервису в целом
+	Regions  bool   // детализация по регионам
+}
+
+// LBSCalibrationStats описывает распределение ошибок ответов сервиса.
+type LBSCalibrationStats struct {
+	Provider string  // название сервиса
+	Region   string  // geohash региона
+	Samples  int     // количество ошибок
+	Error50  float64 // медиана ошибки, м
+	Error68  float64 // 68-й процентиль ошибки, м
+	Error95  float64 // 95-й процентиль ошибки, м
+	Scale    float64 // коэффициент калибровки
+}
+
+// record сохраняет ответы сервисов для последующего сравнения с координатами
+// GPS устройства. Сохраняется погрешность, заявленная сервисом.
+func (c *LBSCalibration) record(device string, t time.Time, list []LBSResponse) {
+	if c == nil || device == "" {
+		return
+	}
+	session := c.answers.Database.Session.Copy()
+	defer session.Close()
+	coll := session.DB(c.answers.Database.Name).C(c.answers.Name)
+	for _, resp := range list {
+		accuracy := resp.Accuracy
+		if resp.Reported > 0 {
+			accuracy = resp.Reported
+		}
+		if accuracy <= 0 || resp.Provider == "" {
+			continue
+		}
+		err := coll.Insert(lbsAnswer{
+			ID:       bson.NewObjectId(),
+			Device:   device,
+			Time:     t,
+			Created:  time.Now(),
+			Provider: resp.Provider,
+			Point:    resp.Point,
+			Accuracy: accuracy,
+		})
+		if err != nil {
+			log.Println("LBS: calibration error:", err)
+			return
+		}
+	}
+}
+
+// truth сравнивает сохраненные ответы для устройства, полученные не дальше
+// Window от времени определения координат GPS, с этими координатами и
+// сохраняет ошибки. Учтенные ответы удаляются.
+func (c *LBSCalibration) truth(device string, point Point, accuracy float64,
+	t time.Time) error {
+	if c == nil || device == "" || accuracy <= 0 || accuracy > c.MaxAccuracy {
+		return nil
+	}
+	session := c.answers.Database.Session.Copy()
+	defer session.Close()
+	answers := session.DB(c.answers.Database.Name).C(c.answers.Name)
+	var list []lbsAnswer
+	err := answers.Find(bson.M{
+		"device": device,
+		"time": bson.M{
+			"$gte": t.Add(-c.Window),
+			"$lte": t.Add(c.Window),
+		},
+	}).All(&list)
+	if err != nil || len(list) == 0 {
+		return err
+	}
+	coll := session.DB(c.coll.Database.Name).C(c.coll.Name)
+	region := Geohash(point, c.Precision)
+	ids := make([]bson.ObjectId, len(list))
+	for i, answer := range list {
+		ids[i] = answer.ID
+		distance := Distance(answer.Point, point)
+		err := coll.Insert(lbsError{
+			Provider: answer.Provider,
+			Region:   region,
+			Error:    distance,
+			Accuracy: answer.Accuracy,
+			Ratio:    distance / answer.Accuracy,
+			Time:     answer.Time,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	_, err = answers.RemoveAll(bson.M{"_id": bson.M{"$in": ids}})
+	return err
+}
+
+// rescale изменяет погрешность ответа по коэффициенту калибровки сервиса для
+// региона ответа. Исходная погрешность сохраняется в Reported.
+func (c *LBSCalibration) rescale(resp *LBSResponse) {
+	scale := c.scale(resp.Provider, Geohash(resp.Point, c.Precision))
+	if scale <= 0 {
+		return
+	}
+	resp.Reported = resp.Accuracy
+	resp.Accuracy *= scale
+}
+
+// scale возвращает коэффициент калибровки для сервиса в регионе. Если ошибок
+// в регионе недостаточно, то используется коэффициент по сервису в целом.
+// Если недостаточно и их, то возвращается 0.
+func (c *LBSCalibration) scale(provider, region string) float64 {
+	for _, region := range []string{region, ""} {
+		key := provider + "|" + region
+		c.mu.Lock()
+		cached, ok := c.scales[key]
+		c.mu.Unlock()
+		if !ok || time.Since(cached.time) > c.Interval {
+			ratios, err := c.ratios(provider, region)
+			if err != nil {
+				log.Println("LBS: calibration error:", err)
+				return 0
+			}
+			cached = lbsScale{time: time.Now()}
+			if len(ratios) >= c.MinSamples {
+				sort.Float64s(ratios)
+				cached.value = quantile(ratios, c.Percentile)
+			}
+			c.mu.Lock()
+			if c.scales == nil {
+				c.scales = make(map[string]lbsScale)
+			}
+			c.scales[key] = cached
+			c.mu.Unlock()
+		}
+		if cached.value > 0 {
+			return cached.value
+		}
+	}
+	return 0
+}
+
+// ratios возвращает отношения ошибки к погрешности для последних ответов
+// сервиса в регионе или для сервиса в целом, если регион не задан.
+func (c *LBSCalibration) ratios(provider, region string) ([]float64, error) {
+	session := c.coll.Database.Session.Copy()
+	defer session.Close()
+	coll := session.DB(c.coll.Database.Name).C(c.coll.Name)
+	query := bson.M{"provider": provider}
+	if region != "" {
+		query["region"] = region
+	}
+	var list []struct{ Ratio float64 }
+	err := coll.Find(query).Sort("-time").Limit(lbsCalibrationSamples).
+		Select(bson.M{"ratio": 1, "_id": 0}).All(&list)
+	if err != nil {
+		return nil, err
+	}
+	ratios := make([]float64, len(list))
+	for i, item := range list {
+		ratios[i] = item.Ratio
+	}
+	return ratios, nil
+}
+
+// quantile возвращает квантиль отсортированного списка значений.
+func quantile(values []float64, p float64) float64 {
+	if len(values) == 0 {
+		return 0
+	}
+	pos := p * float64(len(values)-1)
+	i := int(math.Floor(pos))
+	if i+1 >= len(values) {
+		return values[len(values)-1]
+	}
+	return values[i] + (values[i+1]-values[i])*(pos-float64(i))
+}
+
+// CalibrationStats возвращает распределение ошибок ответов сервисов геолокации по
+// сервисам и, если задана детализация, по регионам.
+func (s *LBS) CalibrationStats(req LBSCalibrationRequest,
+	stats *[]LBSCalibrationStats) error {
+	c := s.Calibration
+	if c == nil || c.coll == nil {
+		return errors.New("LBS: calibration not initialized")
+	}
+	query := bson.M{}
+	if req.Provider != "" {
+		query["provider"] = req.Provider
+	}
+	if req.Region != "" {
+		query["region"] = req.Region
+	}
+	session := c.coll.Database.Session.Copy()
+	defer session.Close()
+	coll := session.DB(c.coll.Database.Name).C(c.coll.Name)
+	type group struct {
+		provider, region string
+		errors, ratios   []float64
+	}
+	groups := make(map[string]*group)
+	var keys []string
+	iter := coll.Find(query).Select(bson.M{"_id": 0}).Iter()
+	var item lbsError
+	for iter.Next(&item) {
+		region := req.Region
+		if req.Regions {
+			region = item.Region
+		}
+		key := item.Provider + "|" + region
+		g := groups[key]
+		if g == nil {
+			g = &group{provider: item.Provider, region: region}
+			groups[key] = g
+			keys = append(keys, key)
+		}
+		g.errors = append(g.errors, item.Error)
+		g.ratios = append(g.ratios, item.Ratio)
+	}
+	if err := iter.Close(); err != nil {
+		return err
+	}
+	sort.Strings(keys)
+	list := make([]LBSCalibrationStats, 0, len(keys))
+	for _, key := range keys {
+		g := groups[key]
+		sort.Float64s(g.errors)
+		sort.Float64s(g.ratios)
+		list = append(list, LBSCalibrationStats{
+			Provider: g.provider,
+			Region:   g.region,
+			Samples:  len(g.errors),
+			Error50:  quantile(g.errors, 0.5),
+			Error68:  quantile(g.errors, 0.68),
+			Error95:  quantile(g.errors, 0.95),
+			Scale:    quantile(g.ratios, c.Percentile),
+		})
+	}
+	*stats = list
+	return nil
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// consensus параллельно запрашивает координаты у всех сервисов геолокации и
+// объединяет их ответы.
+func (s *LBS) consensus(query *lbsQuery, resp *LBSResponse) error {
+	answers := make([]*LBSResponse, len(s.providers))
+	errs := make([]error, len(s.providers))
+	var wg sync.WaitGroup
+	for i, provider := range s.providers {
+		wg.Add(1)
+		go func(i int, provider *lbsProvider) {
+			defer wg.Done()
+			answers[i], errs[i] = s.request(provider, query)
+		}(i, provider)
+	}
+	wg.Wait()
+	var (
+		list    []LBSResponse
+		msgs    []string
+		lastErr error
+	)
+	for i, answer := range answers {
+		if errs[i] != nil {
+			msgs = append(msgs, fmt.Sprintf("%s: %v", s.providers[i].name, errs[i]))
+			lastErr = errs[i]
+			continue
+		}
+		list = append(list, *answer)
+	}
+	if len(list) == 0 {
+		if len(msgs) == 1 {
+			return lastErr
+		}
+		return fmt.Errorf("LBS: all providers failed: %s", strings.Join(msgs, "; "))
+	}
+	*resp = fuseLBS(list)
+	return nil
+}
+
+// fuseLBS объединяет ответы нескольких сервисов геолокации.
+//
+// Ответы, которые не согласуются с большинством, отбрасываются: ответы
+// считаются согласованными, если расстояние между ними не превышает суммы их
+// погрешностей. Из оставшихся ответов вычисляется средняя точка с весами,
+// обратно пропорциональными квадрату погрешности. Погрешность результата
+// учитывает как погрешности ответов, так и их разброс относительно средней
+// точки. Все ответы, включая отброшенные, возвращаются в Answers.
+func fuseLBS(list []LBSResponse) LBSResponse {
+	// выбираем самую большую группу ответов, согласованных с одним из них, а
+	// при равном размере — группу с меньшей суммарной погрешностью
+	var (
+		best    []int
+		bestAcc float64
+	)
+	for i := range list {
+		var (
+			group []int
+			acc   float64
+		)
+		for j := range list {
+			if Distance(list[i].Point, list[j].Point) <=
+				list[i].Accuracy+list[j].Accuracy {
+				group = append(group, j)
+				acc += list[j].Accuracy
+			}
+		}
+		if len(group) > len(best) || (len(group) == len(best) && acc < bestAcc) {
+			best, bestAcc = group, acc
+		}
+	}
+	answers := make([]LBSResponse, len(list))
+	for i, answer := range list {
+		answers[i] = answer
+		answers[i].Rejected = true
+	}
+	var (
+		lon, lat, sum float64
+		names         []string
+	)
+	for _, i := range best {
+		answers[i].Rejected = false
+		w := 1 / (list[i].Accuracy * list[i].Accuracy)
+		lon += list[i].Point[0] * w
+		lat += list[i].Point[1] * w
+		sum += w
+		names = append(names, list[i].Provider)
+	}
+	center := NewPoint(lon/sum, lat/sum)
+	var spread float64 // взвешенный средний квадрат отклонения от центра
+	for _, i := range best {
+		d := Distance(center, list[i].Point)
+		spread += d * d / (list[i].Accuracy * list[i].Accuracy)
+	}
+	spread /= sum
+	sort.Strings(names)
+	return LBSResponse{
+		Point:    center,
+		Accuracy: math.Sqrt(1/sum + spread),
+		Provider: strings.Join(names, "+"),
+		Answers:  answers,
+	}
+}
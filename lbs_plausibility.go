@@ -0,0 +1,233 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"sort"
+	"time"
+
+	"gopkg.in/mgo.v2"
+)
+
+// LBSPlausibility описывает настройки проверки правдоподобности координат по
+// истории перемещений устройства.
+//
+// Если переход от последних известных координат устройства к полученным
+// требует скорости выше допустимой, то запрос повторяется без одной из вышек
+// или точек доступа: сначала исключаются те, чьи известные координаты дальше
+// всего от устройства, затем — со слабым сигналом. Если и это не помогает, то
+// ответ помечается как подозрительный или, если задано Reject, возвращается
+// ошибка.
+//
+// Если последние координаты устройства неизвестны, то их задают координаты
+// GPS (из LBS.Observe или поля GPS запроса) или ответ с погрешностью не больше
+// SeedAccuracy: иначе первый же ошибочный ответ стал бы точкой отсчета.
+type LBSPlausibility struct {
+	MaxSpeed     float64       // максимальная скорость устройства, м/с (по умолчанию 55)
+	MaxAge       time.Duration // время, после которого координаты не учитываются (по умолчанию 12 часов)
+	Retries      int           // количество повторных запросов (по умолчанию 2)
+	Reject       bool          // возвращать ошибку вместо пометки ответа
+	SeedAccuracy float64       // максимальная погрешность ответа для начальных координат, м (по умолчанию 100)
+
+	coll *mgo.Collection // последние известные координаты устройств
+}
+
+// errImplausible возвращается для неправдоподобных координат, если задано
+// Reject.
+var errImplausible = errors.New("LBS: implausible location")
+
+// lbsDevicePosition описывает последние известные координаты устройства.
+type lbsDevicePosition struct {
+	Device   string    `bson:"_id"` // идентификатор устройства
+	Point    Point     // координаты
+	Accuracy float64   // погрешность, м
+	Time     time.Time // время определения координат
+}
+
+// last возвращает последние известные координаты устройства или nil, если
+// они неизвестны.
+func (p *LBSPlausibility) last(device string) (*lbsDevicePosition, error) {
+	session := p.coll.Database.Session.Copy()
+	defer session.Close()
+	coll := session.DB(p.coll.Database.Name).C(p.coll.Name)
+	last := new(lbsDevicePosition)
+	err := coll.FindId(device).One(last)
+	if err == mgo.ErrNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return last, nil
+}
+
+// save сохраняет последние известные координаты устройства.
+func (p *LBSPlausibility) save(pos lbsDevicePosition) error {
+	session := p.coll.Database.Session.Copy()
+	defer session.Close()
+	coll := session.DB(p.coll.Database.Name).C(p.coll.Name)
+	_, err := coll.UpsertId(pos.Device, pos)
+	return err
+}
+
+// speed возвращает минимальную скорость, необходимую для перемещения от
+// последних известных координат к новым, с учетом погрешности обоих.
+func (pos lbsDevicePosition) speed(point Point, accuracy float64, t time.Time) float64 {
+	distance := Distance(pos.Point, point) - pos.Accuracy - accuracy
+	if distance <= 0 {
+		return 0
+	}
+	return distance / math.Max(math.Abs(t.Sub(pos.Time).Seconds()), 1)
+}
+
+// plausible проверяет правдоподобность ответа по последним известным
+// координатам устройства и при необходимости повторяет запрос без
+// подозрительной вышки или точки доступа.
+func (s *LBS) plausible(req LBSRequest, resp *LBSResponse) error {
+	p := s.Plausibility
+	t := req.Time
+	last, err := p.last(req.Device)
+	if err != nil {
+		return err
+	}
+	// координаты GPS из запроса точнее, если они новее сохраненных
+	if gps := req.GPS; gps != nil && !gps.Time.IsZero() &&
+		(last == nil || gps.Time.After(last.Time)) {
+		last = &lbsDevicePosition{
+			Device:   req.Device,
+			Point:    gps.Point,
+			Accuracy: gps.Accuracy,
+			Time:     gps.Time,
+		}
+	}
+	current := lbsDevicePosition{Device: req.Device, Time: t}
+	// в истории нет координат, с которыми можно сравнить ответ: точкой
+	// отсчета становится только достаточно точный ответ
+	if last == nil || t.Sub(last.Time) > p.MaxAge || t.Sub(last.Time) < -p.MaxAge {
+		if resp.Accuracy > p.SeedAccuracy {
+			return nil
+		}
+		current.Point, current.Accuracy = resp.Point, resp.Accuracy
+		return p.save(current)
+	}
+	resp.Speed = last.speed(resp.Point, resp.Accuracy, t)
+	if resp.Speed > p.MaxSpeed {
+		suspects := s.suspects(req, last.Point)
+		if len(suspects) > p.Retries {
+			suspects = suspects[:p.Retries]
+		}
+		for _, id := range suspects {
+			reduced := excludeLBS(req, id)
+			if len(reduced.Cells)+len(reduced.Wifi) == 0 {
+				continue
+			}
+			var retry LBSResponse
+			if err := s.locate(s.query(reduced), &retry); err != nil {
+				continue
+			}
+			retry.Speed = last.speed(retry.Point, retry.Accuracy, t)
+			if retry.Speed <= p.MaxSpeed {
+				retry.Excluded = id
+				*resp = retry
+				break
+			}
+		}
+	}
+	if resp.Speed > p.MaxSpeed {
+		if p.Reject {
+			return errImplausible
+		}
+		resp.Suspicious = true
+		return nil
+	}
+	// более старые координаты не заменяют последние известные
+	if t.After(last.Time) {
+		current.Point, current.Accuracy = resp.Point, resp.Accuracy
+		return p.save(current)
+	}
+	return nil
+}
+
+// suspects возвращает идентификаторы вышек и точек доступа из запроса в
+// порядке убывания подозрительности: сначала известные, по удаленности от
+// последних координат устройства, затем остальные, по возрастанию уровня
+// сигнала.
+func (s *LBS) suspects(req LBSRequest, from Point) []string {
+	type suspect struct {
+		id       string
+		distance float64 // расстояние или -1, если координаты неизвестны
+		signal   int16
+	}
+	var list []suspect
+	for _, tower := range req.Cells {
+		list = append(list, suspect{
+			id:       tower.key(),
+			distance: -1,
+			signal:   tower.Signal,
+		})
+	}
+	cellsCount := len(list)
+	for _, wifi := range req.Wifi {
+		list = append(list, suspect{
+			id:       wifi.MAC,
+			distance: -1,
+			signal:   wifi.Signal,
+		})
+	}
+	if s.cells != nil {
+		ids := make([]string, len(list))
+		for i, item := range list {
+			ids[i] = item.id
+		}
+		session := s.cells.coll.Database.Session.Copy()
+		defer session.Close()
+		cells, _ := findCells(session.DB(s.cells.coll.Database.Name).
+			C(s.cells.coll.Name), ids[:cellsCount])
+		var wifi map[string]Cell
+		if s.cells.wifi != nil {
+			wifi, _ = findCells(session.DB(s.cells.wifi.Database.Name).
+				C(s.cells.wifi.Name), ids[cellsCount:])
+		}
+		for i := range list {
+			known := cells
+			if i >= cellsCount {
+				known = wifi
+			}
+			if cell, ok := known[list[i].id]; ok {
+				if point, _, ok := cell.position(); ok {
+					list[i].distance = Distance(from, point)
+				}
+			}
+		}
+	}
+	sort.SliceStable(list, func(i, j int) bool {
+		if list[i].distance != list[j].distance {
+			return list[i].distance > list[j].distance
+		}
+		return list[i].signal < list[j].signal
+	})
+	ids := make([]string, len(list))
+	for i, item := range list {
+		ids[i] = item.id
+	}
+	return ids
+}
+
+// excludeLBS возвращает копию запроса без вышки или точки доступа с указанным
+// идентификатором.
+func excludeLBS(req LBSRequest, id string) LBSRequest {
+	cells := make([]LBSCell, 0, len(req.Cells))
+	for _, cell := range req.Cells {
+		if cell.key() != id {
+			cells = append(cells, cell)
+		}
+	}
+	wifi := make([]LBSWifi, 0, len(req.Wifi))
+	for _, ap := range req.Wifi {
+		if ap.MAC != id {
+			wifi = append(wifi, ap)
+		}
+	}
+	req.Cells, req.Wifi = cells, wifi
+	return req
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+)
+
+// причины исключения точек доступа из запроса
+const (
+	lbsDropNoMap   = "nomap"   // владелец запретил использовать точку доступа
+	lbsDropLocal   = "local"   // локально администрируемый или случайный MAC-адрес
+	lbsDropHotspot = "hotspot" // точка доступа мобильного устройства
+	lbsDropMinimum = "minimum" // точек доступа меньше минимального количества
+)
+
+// hotspotSSID возвращает true, если название сети совпадает с названием,
+// которое телефон по умолчанию дает точке доступа: AndroidAP с необязательным
+// суффиксом или iPhone с именем владельца. Названия по маркам устройств не
+// проверяются, так как их используют и стационарные роутеры.
+func hotspotSSID(ssid string) bool {
+	if rest := strings.TrimPrefix(ssid, "androidap"); rest != ssid {
+		return strings.Trim(rest, "_-0123456789abcdef") == ""
+	}
+	return ssid == "iphone" || strings.HasPrefix(ssid, "iphone (") ||
+		strings.HasSuffix(ssid, "'s iphone") || strings.HasSuffix(ssid, "’s iphone")
+}
+
+// wifiDropReason возвращает причину, по которой точка доступа не должна
+// передаваться внешним сервисам, или пустую строку.
+func wifiDropReason(wifi LBSWifi) string {
+	ssid := strings.ToLower(wifi.SSID)
+	// соглашения Google и Mozilla для отказа от использования точки доступа
+	if strings.HasSuffix(ssid, "_nomap") || strings.Contains(ssid, "_optout") {
+		return lbsDropNoMap
+	}
+	// MAC-адрес разобран при проверке запроса и имеет вид 01:23:45:67:89:ab:
+	// второй младший бит первого байта означает локально администрируемый
+	// адрес, которые используются для случайных адресов
+	first, _ := strconv.ParseUint(wifi.MAC[:2], 16, 8)
+	if first&0x02 != 0 {
+		return lbsDropLocal
+	}
+	if wifi.Hotspot || hotspotSSID(ssid) {
+		return lbsDropHotspot
+	}
+	return ""
+}
+
+// filterWifi удаляет из запроса точки доступа, которые нельзя или не имеет
+// смысла передавать внешним сервисам, и возвращает количество удаленных точек
+// доступа по причинам. Если точек доступа остается меньше минимального
+// количества, то удаляются все.
+func filterWifi(req *LBSRequest, minimum int) map[string]int {
+	var dropped map[string]int
+	drop := func(reason string, count int) {
+		if dropped == nil {
+			dropped = make(map[string]int)
+		}
+		dropped[reason] += count
+	}
+	wifi := req.Wifi[:0:0]
+	for _, ap := range req.Wifi {
+		if reason := wifiDropReason(ap); reason != "" {
+			drop(reason, 1)
+			continue
+		}
+		wifi = append(wifi, ap)
+	}
+	if len(wifi) > 0 && len(wifi) < minimum {
+		drop(lbsDropMinimum, len(wifi))
+		wifi = nil
+	}
+	req.Wifi = wifi
+	return dropped
+}
@@ -0,0 +1,393 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mdigger/geolocate"
+)
+
+// LBSProvider описывает настройки внешнего сервиса геолокации.
+type LBSProvider struct {
+	Type    string        // название сервиса (Google, Mozilla, Yandex, Local)
+	Token   string        // токен для пользования сервисом
+	Timeout time.Duration // время ожидания ответа (по умолчанию 30 секунд)
+	Rate    float64       // максимальное количество запросов в секунду
+	MaxWait time.Duration // максимальное ожидание очереди при ограничении Rate (по умолчанию 1 секунда)
+}
+
+// lbsTimeout задает время ожидания ответа сервиса по умолчанию: без него один
+// зависший сервис блокирует перебор остальных.
+const lbsTimeout = time.Second * 30
+
+// lbsMaxWait задает максимальное ожидание очереди запроса по умолчанию.
+const lbsMaxWait = time.Second
+
+// errLBSRate возвращается, если очередь запроса к сервису наступит позже
+// допустимого времени ожидания.
+var errLBSRate = errors.New("LBS: rate limit exceeded")
+
+// lbsProvider описывает внешний сервис геолокации.
+//
+// Запросы к сервисам выполняются собственным клиентом, а не через
+// geolocate.Locator: тот читает ответ целиком сам и не дает ограничить его
+// размер, а его формат запроса не содержит части передаваемых данных.
+type lbsProvider struct {
+	name    string       // название сервиса
+	url     string       // адрес сервиса
+	token   string       // токен для пользования сервисом
+	client  *http.Client // http-клиент для запроса
+	maxSize int64        // максимальный размер ответа
+	cells   *cellsDB     // база данных вышек для локального сервиса
+
+	mu       sync.Mutex    // блокировка доступа к расписанию запросов
+	interval time.Duration // минимальный интервал между запросами
+	maxWait  time.Duration // максимальное ожидание очереди
+	next     time.Time     // время, раньше которого нельзя делать запрос
+}
+
+// newLBSProvider возвращает инициализированный внешний сервис геолокации с
+// указанными настройками. Локальный сервис использует базу данных вышек.
+func newLBSProvider(config LBSProvider, maxSize int64,
+	cells *cellsDB) (*lbsProvider, error) {
+	name, token := config.Type, config.Token
+	provider := &lbsProvider{
+		name:    strings.ToLower(name),
+		token:   token,
+		client:  &http.Client{Timeout: config.Timeout},
+		maxSize: maxSize,
+	}
+	if config.Rate > 0 {
+		provider.interval = time.Duration(float64(time.Second) / config.Rate)
+		provider.maxWait = config.MaxWait
+		if provider.maxWait <= 0 {
+			provider.maxWait = lbsMaxWait
+		}
+	}
+	switch provider.name {
+	case "mozilla":
+		provider.url = geolocate.Mozilla
+	case "google":
+		provider.url = geolocate.Google
+	case "yandex":
+		provider.url = geolocate.Yandex
+	case "local":
+		if cells == nil {
+			return nil, errors.New("LBS: cells database not initialized")
+		}
+		provider.cells = cells
+		return provider, nil
+	default:
+		return nil, fmt.Errorf("unknown LBS service name: %s", name)
+	}
+	return provider, nil
+}
+
+// Get осуществляет запрос к внешнему сервису геолокации. Функция sent
+// вызывается непосредственно перед отправкой запроса сервису: при ошибке
+// ограничения частоты или формирования запроса она не вызывается.
+func (p *lbsProvider) Get(req LBSRequest, sent func()) (*LBSResponse, error) {
+	if p.cells != nil {
+		result, err := p.cells.locate(req)
+		if err != nil {
+			return nil, err
+		}
+		result.Provider = p.name
+		return result, nil
+	}
+	var (
+		httpReq *http.Request
+		err     error
+	)
+	if err := p.wait(); err != nil {
+		return nil, err
+	}
+	if p.name == "yandex" {
+		httpReq, err = p.yandexRequest(req)
+	} else {
+		httpReq, err = p.googleRequest(req)
+	}
+	if err != nil {
+		return nil, err
+	}
+	sent()
+	resp, err := p.client.Do(httpReq)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	data, err := readLimited(resp.Body, p.maxSize)
+	if err != nil {
+		return nil, fmt.Errorf("LBS: %v", err)
+	}
+	var result *LBSResponse
+	if p.name == "yandex" {
+		result, err = parseYandexResponse(resp.StatusCode, data)
+	} else {
+		result, err = parseGoogleResponse(resp.StatusCode, data)
+	}
+	if err != nil {
+		return nil, err
+	}
+	result.Provider = p.name
+	return result, nil
+}
+
+// wait ожидает возможности сделать запрос, чтобы не превышать ограничение
+// сервиса на количество запросов в секунду. Если очередь наступит позже
+// максимального времени ожидания, то место в ней не занимается и
+// возвращается ошибка, чтобы запрос был передан следующему сервису.
+func (p *lbsProvider) wait() error {
+	if p.interval == 0 {
+		return nil
+	}
+	p.mu.Lock()
+	now := time.Now()
+	if p.next.Before(now) {
+		p.next = now
+	}
+	delay := p.next.Sub(now)
+	if delay > p.maxWait {
+		p.mu.Unlock()
+		return errLBSRate
+	}
+	p.next = p.next.Add(p.interval)
+	p.mu.Unlock()
+	time.Sleep(delay)
+	return nil
+}
+
+// googleRequest возвращает запрос в формате Google Geolocation API, который
+// поддерживает так же Mozilla Location Service. Сервис Mozilla принимает тип
+// сети для каждой вышки, но не поддерживает сети NR.
+func (p *lbsProvider) googleRequest(req LBSRequest) (*http.Request, error) {
+	mozilla := p.name == "mozilla"
+	type cellTower struct {
+		RadioType         string `json:"radioType,omitempty"`
+		CellID            uint64 `json:"cellId,omitempty"`
+		NewRadioCellID    uint64 `json:"newRadioCellId,omitempty"`
+		LocationAreaCode  uint32 `json:"locationAreaCode"`
+		MobileCountryCode uint16 `json:"mobileCountryCode"`
+		MobileNetworkCode uint16 `json:"mobileNetworkCode"`
+		Age               uint32 `json:"age,omitempty"`
+		SignalStrength    int16  `json:"signalStrength,omitempty"`
+		TimingAdvance     uint16 `json:"timingAdvance,omitempty"`
+	}
+	type wifiAccessPoint struct {
+		MacAddress         string `json:"macAddress"`
+		SignalStrength     int16  `json:"signalStrength,omitempty"`
+		Age                uint32 `json:"age,omitempty"`
+		Channel            uint8  `json:"channel,omitempty"`
+		SignalToNoiseRatio uint16 `json:"signalToNoiseRatio,omitempty"`
+	}
+	type fallbacks struct {
+		LAC bool `json:"lacf"`
+		IP  bool `json:"ipf"`
+	}
+	body := struct {
+		HomeMobileCountryCode uint16            `json:"homeMobileCountryCode,omitempty"`
+		HomeMobileNetworkCode uint16            `json:"homeMobileNetworkCode,omitempty"`
+		RadioType             string            `json:"radioType,omitempty"`
+		Carrier               string            `json:"carrier,omitempty"`
+		ConsiderIP            bool              `json:"considerIp"`
+		CellTowers            []cellTower       `json:"cellTowers,omitempty"`
+		WifiAccessPoints      []wifiAccessPoint `json:"wifiAccessPoints,omitempty"`
+		Fallbacks             *fallbacks        `json:"fallbacks,omitempty"`
+	}{
+		HomeMobileCountryCode: req.HomeMCC,
+		HomeMobileNetworkCode: req.HomeMNC,
+		RadioType:             req.RadioType,
+		Carrier:               req.Carrier,
+		ConsiderIP:            req.ConsiderIP,
+	}
+	for _, cell := range req.Cells {
+		if mozilla && cell.Radio == "nr" {
+			continue
+		}
+		tower := cellTower{
+			LocationAreaCode:  cell.LAC,
+			MobileCountryCode: cell.MCC,
+			MobileNetworkCode: cell.MNC,
+			Age:               cell.Age,
+			SignalStrength:    cell.Signal,
+			TimingAdvance:     cell.TimingAdvance,
+		}
+		if cell.Radio == "nr" {
+			tower.NewRadioCellID = cell.CellID
+		} else {
+			tower.CellID = cell.CellID
+		}
+		if mozilla {
+			tower.RadioType = cell.Radio
+		}
+		body.CellTowers = append(body.CellTowers, tower)
+	}
+	// Google принимает только общий тип сети для всех вышек
+	if !mozilla && body.RadioType == "" && len(req.Cells) > 0 {
+		body.RadioType = req.Cells[0].Radio
+	}
+	for _, wifi := range req.Wifi {
+		body.WifiAccessPoints = append(body.WifiAccessPoints, wifiAccessPoint{
+			MacAddress:         wifi.MAC,
+			SignalStrength:     wifi.Signal,
+			Age:                wifi.Age,
+			Channel:            wifi.Channel,
+			SignalToNoiseRatio: wifi.SNR,
+		})
+	}
+	if mozilla {
+		body.Fallbacks = &fallbacks{LAC: req.FallbackLAC, IP: req.ConsiderIP}
+	}
+	data, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+	httpReq, err := http.NewRequest("POST",
+		p.url+"?key="+url.QueryEscape(p.token), bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	if req.IPAddress != "" {
+		httpReq.Header.Set("X-Forwarded-For", req.IPAddress)
+	}
+	return httpReq, nil
+}
+
+// parseGoogleResponse разбирает ответ в формате Google Geolocation API.
+func parseGoogleResponse(status int, data []byte) (*LBSResponse, error) {
+	var result struct {
+		Location struct {
+			Lat float64 `json:"lat"`
+			Lng float64 `json:"lng"`
+		} `json:"location"`
+		Accuracy float64 `json:"accuracy"`
+		Error    *struct {
+			Code    int    `json:"code"`
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	if err := json.Unmarshal(data, &result); err != nil {
+		return nil, fmt.Errorf("LBS: bad response %d: %v", status, err)
+	}
+	if result.Error != nil {
+		return nil, fmt.Errorf("LBS: %d %s", result.Error.Code, result.Error.Message)
+	}
+	if status != http.StatusOK {
+		return nil, fmt.Errorf("LBS: bad response %d", status)
+	}
+	return newLBSResponse(result.Location.Lng, result.Location.Lat, result.Accuracy)
+}
+
+// yandexRequest возвращает запрос в формате Яндекс.Локатора. Яндекс.Локатор
+// не поддерживает сети NR и CDMA.
+func (p *lbsProvider) yandexRequest(req LBSRequest) (*http.Request, error) {
+	type gsmCell struct {
+		CountryCode    uint16 `json:"countrycode"`
+		OperatorID     uint16 `json:"operatorid"`
+		CellID         uint64 `json:"cellid"`
+		LAC            uint32 `json:"lac"`
+		SignalStrength int16  `json:"signal_strength,omitempty"`
+		Age            uint32 `json:"age,omitempty"`
+	}
+	type wifiNetwork struct {
+		MAC            string `json:"mac"`
+		SignalStrength int16  `json:"signal_strength,omitempty"`
+		Age            uint32 `json:"age,omitempty"`
+	}
+	type common struct {
+		Version string `json:"version"`
+		APIKey  string `json:"api_key"`
+	}
+	type ip struct {
+		AddressV4 string `json:"address_v4"`
+	}
+	body := struct {
+		Common       common        `json:"common"`
+		GSMCells     []gsmCell     `json:"gsm_cells,omitempty"`
+		WifiNetworks []wifiNetwork `json:"wifi_networks,omitempty"`
+		IP           *ip           `json:"ip,omitempty"`
+	}{
+		Common: common{Version: "1.0", APIKey: p.token},
+	}
+	for _, cell := range req.Cells {
+		if cell.Radio == "nr" || cell.Radio == "cdma" {
+			continue
+		}
+		body.GSMCells = append(body.GSMCells, gsmCell{
+			CountryCode:    cell.MCC,
+			OperatorID:     cell.MNC,
+			CellID:         cell.CellID,
+			LAC:            cell.LAC,
+			SignalStrength: cell.Signal,
+			Age:            cell.Age,
+		})
+	}
+	for _, wifi := range req.Wifi {
+		// Яндекс.Локатор принимает MAC-адреса без разделителей
+		body.WifiNetworks = append(body.WifiNetworks, wifiNetwork{
+			MAC:            strings.Replace(wifi.MAC, ":", "", -1),
+			SignalStrength: wifi.Signal,
+			Age:            wifi.Age,
+		})
+	}
+	if req.ConsiderIP && req.IPAddress != "" {
+		body.IP = &ip{AddressV4: req.IPAddress}
+	}
+	data, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+	form := url.Values{"json": {string(data)}}
+	httpReq, err := http.NewRequest("POST", p.url,
+		strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	httpReq.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return httpReq, nil
+}
+
+// parseYandexResponse разбирает ответ Яндекс.Локатора.
+func parseYandexResponse(status int, data []byte) (*LBSResponse, error) {
+	var result struct {
+		Position *struct {
+			Latitude  float64 `json:"latitude"`
+			Longitude float64 `json:"longitude"`
+			Precision float64 `json:"precision"`
+		} `json:"position"`
+		Error *struct {
+			Code    int    `json:"code"`
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	if err := json.Unmarshal(data, &result); err != nil {
+		return nil, fmt.Errorf("LBS: bad response %d: %v", status, err)
+	}
+	if result.Error != nil {
+		return nil, fmt.Errorf("LBS: %d %s", result.Error.Code, result.Error.Message)
+	}
+	if status != http.StatusOK || result.Position == nil {
+		return nil, fmt.Errorf("LBS: bad response %d", status)
+	}
+	return newLBSResponse(result.Position.Longitude, result.Position.Latitude,
+		result.Position.Precision)
+}
+
+// newLBSResponse проверяет координаты и возвращает ответ сервиса.
+func newLBSResponse(lon, lat, accuracy float64) (*LBSResponse, error) {
+	if lon < -180 || lon > 180 || lat < -90 || lat > 90 {
+		return nil, errors.New("LBS: bad coordinates in response")
+	}
+	return &LBSResponse{
+		Point:    NewPoint(lon, lat),
+		Accuracy: accuracy,
+	}, nil
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// LBSRequest описывает запрос координат по данным сотовых вышек и Wi-Fi.
+// Если задан идентификатор устройства, то результат проверяется на
+// правдоподобность по последним известным координатам устройства.
+type LBSRequest struct {
+	HomeMCC     uint16    // код страны из SIM-карты
+	HomeMNC     uint16    // код оператора из SIM-карты
+	Carrier     string    // название оператора
+	RadioType   string    // тип сети для вышек, у которых он не указан
+	Cells       []LBSCell // сотовые вышки
+	Wifi        []LBSWifi // точки доступа Wi-Fi
+	ConsiderIP  bool      // использовать IP-адрес клиента, если других данных нет
+	IPAddress   string    // IP-адрес клиента
+	FallbackLAC bool      // использовать координаты зоны, если вышка неизвестна
+	GPS         *LBSGPS   // последние координаты GPS устройства
+
+	Device string    // идентификатор устройства
+	Time   time.Time // время измерения; по умолчанию текущее
+
+	// Поля запроса в прежнем формате Google Geolocation API: gob сопоставляет
+	// поля по названию, поэтому без них запросы ранее выпущенных клиентов
+	// остались бы пустыми. При проверке запроса они переносятся в новые поля.
+	HomeMobileCountryCode uint16               // код страны из SIM-карты
+	HomeMobileNetworkCode uint16               // код оператора из SIM-карты
+	ConsiderIp            bool                 // использовать IP-адрес клиента
+	CellTowers            []LBSCellTower       // сотовые вышки
+	WifiAccessPoints      []LBSWifiAccessPoint // точки доступа Wi-Fi
+	Fallbacks             *LBSFallbacks        // дополнительные способы определения
+}
+
+// LBSCellTower описывает сотовую вышку в прежнем формате запроса.
+type LBSCellTower struct {
+	MobileCountryCode uint16 // код страны
+	MobileNetworkCode uint16 // код оператора
+	LocationAreaCode  uint16 // код зоны
+	CellId            uint32 // идентификатор вышки
+	SignalStrength    int16  // уровень сигнала, дБм
+	Age               uint32 // время с момента измерения, мс
+	TimingAdvance     uint8  // значение timing advance
+}
+
+// LBSWifiAccessPoint описывает точку доступа Wi-Fi в прежнем формате запроса.
+type LBSWifiAccessPoint struct {
+	MacAddress         string // MAC-адрес (BSSID)
+	SignalStrength     int16  // уровень сигнала, дБм
+	Age                uint32 // время с момента измерения, мс
+	Channel            uint8  // номер канала
+	SignalToNoiseRatio uint16 // отношение сигнал/шум, дБ
+}
+
+// LBSFallbacks описывает дополнительные способы определения координат в
+// прежнем формате запроса.
+type LBSFallbacks struct {
+	LAC bool // использовать координаты зоны, если вышка неизвестна
+	IP  bool // использовать IP-адрес клиента, если других данных нет
+}
+
+// LBSCell описывает сотовую вышку.
+//
+// Для сетей GSM и WCDMA в LAC передается код зоны (16 бит), для LTE — TAC
+// (16 бит), для NR — TAC (24 бита). CellID содержит CID для GSM (16 бит),
+// UTRAN Cell ID для WCDMA (28 бит), ECI для LTE (28 бит) и NCI для NR (36
+// бит). Для CDMA в MNC передается SID, в LAC — NID, а в CellID — BID.
+type LBSCell struct {
+	Radio         string // тип сети: gsm, wcdma, lte, nr, cdma
+	MCC           uint16 // код страны
+	MNC           uint16 // код оператора
+	LAC           uint32 // код зоны
+	CellID        uint64 // идентификатор вышки
+	Signal        int16  // уровень сигнала, дБм
+	TimingAdvance uint16 // значение timing advance
+	Age           uint32 // время с момента измерения, мс
+}
+
+// LBSWifi описывает точку доступа Wi-Fi.
+type LBSWifi struct {
+	MAC     string // MAC-адрес (BSSID)
+	SSID    string // название сети
+	Signal  int16  // уровень сигнала, дБм
+	Channel uint8  // номер канала
+	SNR     uint16 // отношение сигнал/шум, дБ
+	Age     uint32 // время с момента измерения, мс
+	Hidden  bool   // название сети скрыто
+	Hotspot bool   // точка доступа мобильного устройства
+}
+
+// LBSGPS описывает координаты, определенные устройством по GPS.
+type LBSGPS struct {
+	Point    Point     // координаты
+	Accuracy float64   // погрешность, м
+	Time     time.Time // время определения координат
+}
+
+// lbsCellLimits содержит максимальные значения кода зоны и идентификатора
+// вышки для каждого типа сети.
+var lbsCellLimits = map[string]struct{ lac, cellID uint64 }{
+	"gsm":   {1<<16 - 1, 1<<16 - 1},
+	"wcdma": {1<<16 - 1, 1<<28 - 1},
+	"lte":   {1<<16 - 1, 1<<28 - 1},
+	"nr":    {1<<24 - 1, 1<<36 - 1},
+	"cdma":  {1<<16 - 1, 1<<16 - 1},
+}
+
+// normalize проверяет корректность запроса и приводит данные к единому виду:
+// типы сетей — к нижнему регистру, MAC-адреса — к виду 01:23:45:67:89:ab.
+func (r *LBSRequest) normalize() error {
+	r.convertLegacy()
+	if len(r.Cells) == 0 && len(r.Wifi) == 0 && !r.ConsiderIP {
+		return errors.New("LBS: no cells or access points")
+	}
+	radioType, err := normalizeRadio(r.RadioType)
+	if err != nil {
+		return err
+	}
+	r.RadioType = radioType
+	for i := range r.Cells {
+		cell := &r.Cells[i]
+		if cell.Radio == "" {
+			cell.Radio = r.RadioType
+		}
+		if cell.Radio, err = normalizeRadio(cell.Radio); err != nil {
+			return err
+		}
+		if cell.Radio == "" {
+			cell.Radio = "gsm"
+		}
+		if err := cell.validate(); err != nil {
+			return fmt.Errorf("LBS: bad cell %d: %v", i, err)
+		}
+	}
+	for i := range r.Wifi {
+		wifi := &r.Wifi[i]
+		if wifi.MAC, err = parseMAC(wifi.MAC); err != nil {
+			return fmt.Errorf("LBS: bad access point %d: %v", i, err)
+		}
+		if wifi.Signal > 0 || wifi.Signal < -150 {
+			return fmt.Errorf("LBS: bad access point %d: bad signal %d", i, wifi.Signal)
+		}
+	}
+	if r.GPS != nil {
+		p := r.GPS.Point
+		if p[0] < -180 || p[0] > 180 || p[1] < -90 || p[1] > 90 ||
+			r.GPS.Accuracy < 0 {
+			return errors.New("LBS: bad GPS position")
+		}
+	}
+	return nil
+}
+
+// convertLegacy переносит поля запроса в прежнем формате в новые.
+func (r *LBSRequest) convertLegacy() {
+	if r.HomeMCC == 0 {
+		r.HomeMCC = r.HomeMobileCountryCode
+	}
+	if r.HomeMNC == 0 {
+		r.HomeMNC = r.HomeMobileNetworkCode
+	}
+	r.ConsiderIP = r.ConsiderIP || r.ConsiderIp
+	if r.Fallbacks != nil {
+		r.ConsiderIP = r.ConsiderIP || r.Fallbacks.IP
+		r.FallbackLAC = r.FallbackLAC || r.Fallbacks.LAC
+	}
+	for _, tower := range r.CellTowers {
+		r.Cells = append(r.Cells, LBSCell{
+			MCC:           tower.MobileCountryCode,
+			MNC:           tower.MobileNetworkCode,
+			LAC:           uint32(tower.LocationAreaCode),
+			CellID:        uint64(tower.CellId),
+			Signal:        tower.SignalStrength,
+			TimingAdvance: uint16(tower.TimingAdvance),
+			Age:           tower.Age,
+		})
+	}
+	for _, ap := range r.WifiAccessPoints {
+		r.Wifi = append(r.Wifi, LBSWifi{
+			MAC:     ap.MacAddress,
+			Signal:  ap.SignalStrength,
+			Channel: ap.Channel,
+			SNR:     ap.SignalToNoiseRatio,
+			Age:     ap.Age,
+		})
+	}
+	// дальше используются только новые поля
+	r.HomeMobileCountryCode, r.HomeMobileNetworkCode = 0, 0
+	r.ConsiderIp, r.Fallbacks = false, nil
+	r.CellTowers, r.WifiAccessPoints = nil, nil
+}
+
+// normalizeRadio возвращает название типа сети в нижнем регистре.
+func normalizeRadio(radio string) (string, error) {
+	radio = strings.ToLower(radio)
+	switch radio {
+	case "umts":
+		return "wcdma", nil
+	case "5g":
+		return "nr", nil
+	case "", "gsm", "wcdma", "lte", "nr", "cdma":
+		return radio, nil
+	}
+	return "", fmt.Errorf("LBS: unknown radio type %s", radio)
+}
+
+// validate проверяет значения идентификаторов вышки и уровня сигнала.
+func (c LBSCell) validate() error {
+	limits := lbsCellLimits[c.Radio]
+	switch {
+	case c.MCC < 100 || c.MCC > 999:
+		return fmt.Errorf("bad MCC %d", c.MCC)
+	case c.MNC > 999 && c.Radio != "cdma":
+		return fmt.Errorf("bad MNC %d", c.MNC)
+	case uint64(c.LAC) > limits.lac:
+		return fmt.Errorf("bad %s LAC %d", c.Radio, c.LAC)
+	case c.CellID > limits.cellID:
+		return fmt.Errorf("bad %s cell id %d", c.Radio, c.CellID)
+	case c.Signal > 0 || c.Signal < -150:
+		return fmt.Errorf("bad signal %d", c.Signal)
+	case c.Radio == "gsm" && c.TimingAdvance > 63,
+		c.Radio == "lte" && c.TimingAdvance > 1282:
+		return fmt.Errorf("bad timing advance %d", c.TimingAdvance)
+	}
+	return nil
+}
+
+// key возвращает идентификатор вышки.
+func (c LBSCell) key() string {
+	return cellKey(int64(c.MCC), int64(c.MNC), int64(c.LAC), int64(c.CellID))
+}
+
+// parseMAC разбирает MAC-адрес в одном из форматов 01:23:45:67:89:AB,
+// 01-23-45-67-89-AB, 0123.4567.89AB или 0123456789AB и возвращает его в виде
+// 01:23:45:67:89:ab.
+func parseMAC(mac string) (string, error) {
+	digits := strings.NewReplacer(":", "", "-", "", ".", "").Replace(mac)
+	data, err := hex.DecodeString(digits)
+	if err != nil || len(data) != 6 {
+		return "", fmt.Errorf("bad MAC address %q", mac)
+	}
+	var zero, broadcast = true, true
+	for _, b := range data {
+		zero = zero && b == 0
+		broadcast = broadcast && b == 0xFF
+	}
+	if zero || broadcast {
+		return "", fmt.Errorf("bad MAC address %q", mac)
+	}
+	result := make([]string, len(data))
+	for i, b := range data {
+		result[i] = fmt.Sprintf("%02x", b)
+	}
+	return strings.Join(result, ":"), nil
+}
@@ -0,0 +1,406 @@
+package main
+
+import (
+	"bytes"
+	"encoding/gob"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestLBSFallback(t *testing.T) {
+	failed := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte(`{"error":{"code":403,"message":"limit exceeded"}}`))
+		}))
+	defer failed.Close()
+	empty := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(`{"location":{"lat":0,"lng":0},"accuracy":0}`))
+		}))
+	defer empty.Close()
+	yandex := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			if r.FormValue("json") == "" {
+				t.Error("no request data")
+			}
+			w.Write([]byte(`{"position":{"latitude":55.7,"longitude":37.6,"precision":150}}`))
+		}))
+	defer yandex.Close()
+
+	lbs := &LBS{Providers: []LBSProvider{
+		{Type: "Google", Token: "1"},
+		{Type: "Mozilla", Token: "2"},
+		{Type: "Yandex", Token: "3"},
+	}}
+	if err := lbs.init(); err != nil {
+		t.Fatal(err)
+	}
+	for i, server := range []*httptest.Server{failed, empty, yandex} {
+		lbs.providers[i].url = server.URL
+	}
+	req := LBSRequest{
+		Cells: []LBSCell{{MCC: 250, MNC: 1, LAC: 6101, CellID: 4765}},
+		Wifi:  []LBSWifi{{MAC: "00:18:e4:c8:38:33", Hotspot: true}},
+	}
+	var resp LBSResponse
+	if err := lbs.Get(req, &resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Provider != "yandex" || resp.Accuracy != 150 ||
+		resp.Point != NewPoint(37.6, 55.7) {
+		t.Error("bad response:", resp)
+	}
+	// запрос передавался внешним сервисам без точки доступа телефона
+	if resp.Dropped[lbsDropHotspot] != 1 {
+		t.Error("bad dropped access points:", resp.Dropped)
+	}
+	lbs.providers = lbs.providers[:2]
+	if err := lbs.Get(req, &resp); err == nil {
+		t.Error("no error")
+	}
+}
+
+func TestFuseLBS(t *testing.T) {
+	result := fuseLBS([]LBSResponse{
+		{Point: NewPoint(37.6000, 55.7), Accuracy: 100, Provider: "google"},
+		{Point: NewPoint(37.6020, 55.7), Accuracy: 200, Provider: "yandex"},
+		{Point: NewPoint(38.5000, 55.7), Accuracy: 500, Provider: "mozilla"},
+	})
+	if result.Provider != "google+yandex" {
+		t.Error("bad providers:", result.Provider)
+	}
+	if len(result.Answers) != 3 || !result.Answers[2].Rejected ||
+		result.Answers[0].Rejected {
+		t.Error("outlier not rejected:", result.Answers)
+	}
+	// средняя точка ближе к более точному ответу
+	if d := Distance(result.Point, NewPoint(37.6, 55.7)); d < 10 || d > 40 {
+		t.Error("bad fused point:", result.Point, d)
+	}
+	if result.Accuracy < 89 || result.Accuracy > 200 {
+		t.Error("bad fused accuracy:", result.Accuracy)
+	}
+}
+
+func TestLBSLegacyRequest(t *testing.T) {
+	// запрос ранее выпущенного клиента с полями Google Geolocation API
+	type CellTower struct {
+		MobileCountryCode, MobileNetworkCode, LocationAreaCode uint16
+		CellId                                                 uint32
+		SignalStrength                                         int16
+		Age                                                    uint32
+		TimingAdvance                                          uint8
+	}
+	type WifiAccessPoint struct {
+		MacAddress     string
+		SignalStrength int16
+	}
+	legacy := struct {
+		HomeMobileCountryCode uint16
+		RadioType             string
+		ConsiderIp            bool
+		CellTowers            []CellTower
+		WifiAccessPoints      []WifiAccessPoint
+	}{
+		HomeMobileCountryCode: 250,
+		RadioType:             "LTE",
+		ConsiderIp:            true,
+		CellTowers:            []CellTower{{250, 2, 7743, 22517, -78, 0, 3}},
+		WifiAccessPoints:      []WifiAccessPoint{{"02:18:E4:C8:38:30", -22}},
+	}
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(legacy); err != nil {
+		t.Fatal(err)
+	}
+	var req LBSRequest
+	if err := gob.NewDecoder(&buf).Decode(&req); err != nil {
+		t.Fatal(err)
+	}
+	if err := req.normalize(); err != nil {
+		t.Fatal(err)
+	}
+	if req.HomeMCC != 250 || !req.ConsiderIP || len(req.Cells) != 1 ||
+		req.Cells[0] != (LBSCell{Radio: "lte", MCC: 250, MNC: 2, LAC: 7743,
+			CellID: 22517, Signal: -78, TimingAdvance: 3}) ||
+		len(req.Wifi) != 1 || req.Wifi[0].MAC != "02:18:e4:c8:38:30" ||
+		req.CellTowers != nil || req.WifiAccessPoints != nil {
+		t.Error("bad legacy request:", req)
+	}
+}
+
+func TestLBSFingerprint(t *testing.T) {
+	req := LBSRequest{
+		Cells: []LBSCell{
+			{MCC: 250, MNC: 1, LAC: 6101, CellID: 4765, Signal: -62},
+			{MCC: 250, MNC: 1, LAC: 6101, CellID: 4762, Signal: -56},
+		},
+		Wifi: []LBSWifi{
+			{MAC: "02-18-E4-C8-38-30", Signal: -40},
+			{MAC: "02:18:e4:c8:38:31", Signal: -70},
+			{MAC: "02:18:e4:c8:38:32", Signal: -80},
+		},
+	}
+	if err := req.normalize(); err != nil {
+		t.Fatal(err)
+	}
+	fp := newLBSFingerprint(req)
+	if len(fp.Cells) != 2 || fp.Cells[0] != "250-1-6101-4762" ||
+		len(fp.Wifi) != 3 || fp.Wifi[0] != "02:18:e4:c8:38:30" {
+		t.Fatal("bad fingerprint:", fp)
+	}
+	// одна точка доступа пропала, уровни сигналов немного изменились
+	req.Wifi = req.Wifi[:2]
+	req.Cells[0].Signal = -66
+	similarity, signal := fp.match(newLBSFingerprint(req))
+	if similarity != 0.8 || signal != 1 {
+		t.Error("bad match:", similarity, signal)
+	}
+}
+
+func TestLBSPlausibility(t *testing.T) {
+	now := time.Now()
+	last := lbsDevicePosition{Point: NewPoint(37.6, 55.7), Accuracy: 100,
+		Time: now.Add(-time.Minute)}
+	if speed := last.speed(NewPoint(37.605, 55.7), 500, now); speed != 0 {
+		t.Error("movement within accuracy:", speed)
+	}
+	if speed := last.speed(NewPoint(39.6, 55.7), 500, now); speed < 55 {
+		t.Error("implausible movement not detected:", speed)
+	}
+	req := LBSRequest{
+		Cells: []LBSCell{
+			{MCC: 250, CellID: 1, Signal: -60},
+			{MCC: 250, CellID: 2, Signal: -90},
+		},
+		Wifi: []LBSWifi{{MAC: "02:18:e4:c8:38:30", Signal: -70}},
+	}
+	suspects := new(LBS).suspects(req, last.Point)
+	if len(suspects) != 3 || suspects[0] != "250-0-0-2" ||
+		suspects[1] != "02:18:e4:c8:38:30" {
+		t.Error("bad suspects:", suspects)
+	}
+	reduced := excludeLBS(req, suspects[1])
+	if len(reduced.Cells) != 2 || len(reduced.Wifi) != 0 || len(req.Wifi) != 1 {
+		t.Error("bad reduced request:", reduced)
+	}
+}
+
+func TestLBSRequestNormalize(t *testing.T) {
+	req := LBSRequest{
+		RadioType: "LTE",
+		Cells: []LBSCell{
+			{MCC: 250, MNC: 1, LAC: 6101, CellID: 1<<28 - 1, TimingAdvance: 100},
+			{Radio: "5G", MCC: 250, MNC: 1, LAC: 1 << 20, CellID: 1 << 35},
+		},
+		Wifi: []LBSWifi{{MAC: "0218.E4C8.3830"}, {MAC: "0218E4C83831"}},
+	}
+	if err := req.normalize(); err != nil {
+		t.Fatal(err)
+	}
+	if req.Cells[0].Radio != "lte" || req.Cells[1].Radio != "nr" ||
+		req.Wifi[0].MAC != "02:18:e4:c8:38:30" || req.Wifi[1].MAC != "02:18:e4:c8:38:31" {
+		t.Error("bad normalized request:", req)
+	}
+	for _, bad := range []LBSRequest{
+		{},
+		{Cells: []LBSCell{{MCC: 250, LAC: 1, CellID: 1 << 16}}},       // GSM CID
+		{Cells: []LBSCell{{Radio: "lte", MCC: 250, CellID: 1 << 28}}}, // ECI
+		{Cells: []LBSCell{{Radio: "nr", MCC: 250, LAC: 1 << 24}}},     // TAC
+		{Cells: []LBSCell{{MCC: 25, CellID: 1}}},                      // MCC
+		{Cells: []LBSCell{{Radio: "wimax", MCC: 250, CellID: 1}}},     // тип сети
+		{Cells: []LBSCell{{MCC: 250, CellID: 1, Signal: 10}}},         // сигнал
+		{Wifi: []LBSWifi{{MAC: "02:18:e4:c8:38"}}},                    // MAC
+		{Wifi: []LBSWifi{{MAC: "ff:ff:ff:ff:ff:ff"}}},                 // MAC
+		{ConsiderIP: true, GPS: &LBSGPS{Point: Point{200, 0}}},        // GPS
+	} {
+		if err := bad.normalize(); err == nil {
+			t.Error("bad request accepted:", bad)
+		}
+	}
+}
+
+func TestFilterWifi(t *testing.T) {
+	req := LBSRequest{Wifi: []LBSWifi{
+		{MAC: "00:18:e4:c8:38:30", SSID: "home"},
+		{MAC: "00:18:e4:c8:38:31", SSID: "office_nomap"},
+		{MAC: "da:a1:19:00:00:01", SSID: "cafe"},
+		{MAC: "00:18:e4:c8:38:32", SSID: "iPhone (Anna)"},
+		{MAC: "00:18:e4:c8:38:33", Hotspot: true},
+		{MAC: "00:18:e4:c8:38:34", SSID: "shop"},
+		{MAC: "00:18:e4:c8:38:35", SSID: "AndroidAP_5f2a"},
+		{MAC: "00:18:e4:c8:38:36", SSID: "Galaxy Cinema"}, // стационарный роутер
+	}}
+	dropped := filterWifi(&req, 2)
+	if len(req.Wifi) != 3 || dropped[lbsDropNoMap] != 1 ||
+		dropped[lbsDropLocal] != 1 || dropped[lbsDropHotspot] != 3 {
+		t.Error("bad filter result:", req.Wifi, dropped)
+	}
+	dropped = filterWifi(&req, 4)
+	if len(req.Wifi) != 0 || dropped[lbsDropMinimum] != 3 {
+		t.Error("minimum not enforced:", req.Wifi, dropped)
+	}
+}
+
+func TestLBSGetBatch(t *testing.T) {
+	var (
+		mu    sync.Mutex
+		count int
+	)
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			mu.Lock()
+			count++
+			mu.Unlock()
+			w.Write([]byte(`{"location":{"lat":55.7,"lng":37.6},"accuracy":100}`))
+		}))
+	defer server.Close()
+
+	lbs := &LBS{
+		Providers:   []LBSProvider{{Type: "Google", Token: "1", Rate: 100}},
+		Parallelism: 2,
+	}
+	if err := lbs.init(); err != nil {
+		t.Fatal(err)
+	}
+	lbs.providers[0].url = server.URL
+	cell := LBSCell{MCC: 250, MNC: 1, LAC: 6101, CellID: 4765}
+	reqs := []LBSRequest{
+		{Cells: []LBSCell{cell}},
+		{},
+		{Cells: []LBSCell{cell}},
+		{Cells: []LBSCell{cell}},
+	}
+	start := time.Now()
+	var results []LBSBatchResult
+	if err := lbs.GetBatch(reqs, &results); err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != len(reqs) {
+		t.Fatal("bad results count:", len(results))
+	}
+	for i, result := range results {
+		if i == 1 {
+			if result.Error == "" || result.Response != nil {
+				t.Error("expected error for empty request")
+			}
+			continue
+		}
+		if result.Error != "" || result.Response == nil ||
+			result.Response.Accuracy != 100 {
+			t.Errorf("bad result %d: %+v", i, result)
+		}
+	}
+	if count != 3 {
+		t.Error("bad requests count:", count)
+	}
+	// три запроса с ограничением 100 в секунду занимают не менее 20 мс
+	if time.Since(start) < 20*time.Millisecond {
+		t.Error("rate limit ignored")
+	}
+	// без заданного количества обработчиков пакет все равно обрабатывается
+	lbs.Parallelism = 0
+	if err := lbs.GetBatch(reqs[:1], &results); err != nil ||
+		results[0].Response == nil {
+		t.Error("batch without parallelism not processed:", err)
+	}
+}
+
+func TestLBSProviderWait(t *testing.T) {
+	provider := &lbsProvider{interval: time.Second, maxWait: time.Millisecond * 10}
+	if err := provider.wait(); err != nil {
+		t.Fatal(err)
+	}
+	// очередь слишком далеко: ожидания нет, и место в ней не занимается
+	start := time.Now()
+	next := provider.next
+	if err := provider.wait(); err != errLBSRate {
+		t.Error("expected rate limit error:", err)
+	}
+	if time.Since(start) > provider.maxWait || provider.next != next {
+		t.Error("rate limited request reserved slot")
+	}
+}
+
+func TestLBSProviderSent(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(`{"location":{"lat":55.7,"lng":37.6},"accuracy":100}`))
+		}))
+	defer server.Close()
+	provider, err := newLBSProvider(LBSProvider{Type: "Google", Token: "1",
+		Rate: 1, MaxWait: time.Millisecond * 10}, 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	provider.url = server.URL
+	var count int
+	sent := func() { count++ }
+	req := LBSRequest{Cells: []LBSCell{{MCC: 250, MNC: 1, LAC: 6101, CellID: 4765}}}
+	if _, err := provider.Get(req, sent); err != nil || count != 1 {
+		t.Fatal("request not counted:", err, count)
+	}
+	// запрос сверх ограничения частоты не отправлен и не учитывается
+	if _, err := provider.Get(req, sent); err != errLBSRate || count != 1 {
+		t.Error("rate limited request counted:", err, count)
+	}
+}
+
+func TestUsageLimit(t *testing.T) {
+	usage := &Usage{Limits: []UsageLimit{
+		{Provider: "google", Daily: 100},
+		{Provider: "google", Token: "2", Monthly: 1000},
+	}}
+	if limit := usage.limit("google", "1"); limit == nil || limit.Daily != 100 {
+		t.Error("bad default limit:", limit)
+	}
+	if limit := usage.limit("google", "2"); limit == nil || limit.Monthly != 1000 {
+		t.Error("bad token limit:", limit)
+	}
+	if limit := usage.limit("yandex", "1"); limit != nil {
+		t.Error("unexpected limit:", limit)
+	}
+	if usageKey("secret") == "secret" || len(usageKey("secret")) != 8 {
+		t.Error("bad key id:", usageKey("secret"))
+	}
+	// без настроек учета запросы не ограничиваются
+	var empty *Usage
+	if err := empty.allow("google", "1"); err != nil {
+		t.Error(err)
+	}
+	empty.record("google", "1", "device")
+}
+
+func TestLBSCalibration(t *testing.T) {
+	values := []float64{1, 2, 3, 4, 5}
+	if q := quantile(values, 0.5); q != 3 {
+		t.Error("bad median:", q)
+	}
+	if q := quantile(values, 0.75); q != 4 {
+		t.Error("bad quantile:", q)
+	}
+	if q := quantile(values, 1); q != 5 {
+		t.Error("bad maximum:", q)
+	}
+	point := NewPoint(37.6, 55.7)
+	now := time.Now()
+	c := &LBSCalibration{Precision: 3, Interval: time.Hour}
+	c.scales = map[string]lbsScale{
+		"google|" + Geohash(point, 3): {value: 2.5, time: now},
+		"yandex|" + Geohash(point, 3): {time: now},
+		"yandex|":                     {value: 1.5, time: now},
+	}
+	for provider, accuracy := range map[string]float64{
+		"google": 250, // коэффициент для региона
+		"yandex": 150, // коэффициент для сервиса в целом
+	} {
+		resp := &LBSResponse{Point: point, Accuracy: 100, Provider: provider}
+		c.rescale(resp)
+		if resp.Accuracy != accuracy || resp.Reported != 100 {
+			t.Errorf("bad %s rescale: %+v", provider, resp)
+		}
+	}
+}
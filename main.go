@@ -3,17 +3,53 @@ package main
 import (
 	"flag"
 	"log"
+	"net"
+	"net/http"
 )
 
 func main() {
 	addr := flag.String("addr", ":7777", "service address")
 	config := flag.String("config", "config.json", "configuration filename")
+	simulate := flag.Bool("simulate-ublox", false,
+		"use local U-blox AssistNow simulator")
+	importCells := flag.String("import-cells", "",
+		"import cell towers from OpenCellID or MLS CSV `file` and exit")
+	importGazetteer := flag.String("import-gazetteer", "",
+		"import GeoNames dump or OpenAddresses CSV `file` and exit")
 	flag.Parse()
 	// читаем конфигурацию из файла
 	service, err := LoadConfig(*config)
 	if err != nil {
 		log.Fatal(err)
 	}
+	// загружаем базу данных сотовых вышек
+	if *importCells != "" {
+		count, err := service.ImportCells(*importCells)
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Println("LBS: imported cells:", count)
+		return
+	}
+	// загружаем справочник адресов
+	if *importGazetteer != "" {
+		count, err := service.ImportGazetteer(*importGazetteer)
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Println("GEOCODE: imported places:", count)
+		return
+	}
+	// запускаем имитацию сервиса U-blox и подменяем им серверы U-blox
+	if *simulate && service.Ublox != nil {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			log.Fatal(err)
+		}
+		go http.Serve(listener, &UbloxSimulator{Token: service.Ublox.Token})
+		service.Ublox.Servers = []string{"http://" + listener.Addr().String() + "/"}
+		log.Println("UBLOX: simulator at", service.Ublox.Servers[0])
+	}
 	// регистрируем и запускаем сервисы
 	if err := service.Run(*addr); err != nil {
 		log.Fatal(err)
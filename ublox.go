@@ -4,8 +4,8 @@ import (
 	"bytes"
 	"errors"
 	"fmt"
-	"io/ioutil"
 	"net/http"
+	"sort"
 	"strings"
 	"time"
 
@@ -19,12 +19,36 @@ type Ublox struct {
 	Token       string        // токен для авторизации на сервере
 	Servers     []string      // список серверов
 	Timeout     time.Duration // время ожидания ответа
-	CacheTime   time.Duration // время кеширования ответа от сервисов
+	CacheTime   time.Duration // время кеширования ответа без эфемерид и альманахов
 	MaxDistance float64       // максимальная дистанция совпадения
 	Pacc        uint32        // расстояние погрешности в метрах
+	Offline     *UbloxOffline // настройки загрузки данных AssistNow Offline
+	Refresh     *UbloxRefresh // настройки фонового обновления популярных данных
 
-	client *http.Client    // http-клиент для запроса
-	coll   *mgo.Collection // соединение с MongoDB
+	LocalFilter      bool          // фильтровать эфемериды по видимости спутников на сервере
+	ElevationMask    float64       // минимальный угол возвышения видимого спутника в градусах
+	VisibilityWindow time.Duration // интервал, в течение которого спутник должен быть видим
+	DeltaMaxAge      time.Duration // максимальный возраст эфемерид устройства, которые не передаются повторно
+
+	Balance         string        // порядок опроса серверов: order, latency или roundrobin
+	AttemptTimeout  time.Duration // время ожидания ответа от одного сервера
+	BreakerErrors   int           // количество ошибок подряд, после которого сервер пропускается
+	BreakerCooldown time.Duration // время, в течение которого сервер пропускается
+	Hedge           time.Duration // задержка перед параллельным запросом ко второму серверу
+
+	ContentTime     time.Duration // время хранения наборов данных для загрузки частями
+	MaxResponseSize int64         // максимальный размер ответа сервера в байтах
+
+	MemoryCache int64  // размер кеша данных в памяти в байтах (0 — не использовать)
+	AdminToken  string // токен для управления кешем по HTTP (если не задан, то управление отключено)
+
+	client   *http.Client    // http-клиент для запроса
+	coll     *mgo.Collection // соединение с MongoDB
+	memory   *ubloxMemCache  // кеш данных в памяти
+	contents *mgo.Collection // наборы данных для загрузки частями
+	prefix   string          // путь HTTP-запроса
+	health   ubloxHealth     // статистика доступности серверов
+	usage    *Usage          // учет запросов к серверам
 }
 
 // UbloxProfile описывает профиль возвращаемых данных для данного устройства.
@@ -35,19 +59,114 @@ type UbloxProfile struct {
 	FilterOnPos bool     // If present, the ephemeris data returned to the client will only contain data for the satellites which are likely to be visible from the approximate position provided
 }
 
+// canonical возвращает профиль в каноническом виде: названия в нижнем
+// регистре, списки отсортированы. Это позволяет использовать одни и те же
+// закешированные данные для профилей, отличающихся только порядком значений.
+func (p UbloxProfile) canonical() UbloxProfile {
+	normalize := func(list []string) []string {
+		if len(list) == 0 {
+			return nil
+		}
+		result := make([]string, len(list))
+		for i, value := range list {
+			result[i] = strings.ToLower(strings.TrimSpace(value))
+		}
+		sort.Strings(result)
+		return result
+	}
+	return UbloxProfile{
+		Datatype:    normalize(p.Datatype),
+		Format:      strings.ToLower(strings.TrimSpace(p.Format)),
+		GNSS:        normalize(p.GNSS),
+		FilterOnPos: p.FilterOnPos,
+	}
+}
+
+// key возвращает строковый ключ профиля в каноническом виде.
+func (p UbloxProfile) key() string {
+	p = p.canonical()
+	return fmt.Sprintf("%s;%s;%s;%t", p.Format, strings.Join(p.Datatype, ","),
+		strings.Join(p.GNSS, ","), p.FilterOnPos)
+}
+
 // UbloxRequest описывает входящие параметры для получения данных инициализации
 // геолокации браслета. В них передаются ориентировочные координаты точки и
 // профиль, описывающий устройство.
 type UbloxRequest struct {
 	Point   Point        // координаты точки
+	Pacc    uint32       // погрешность координат в метрах (если не задана, то из настроек)
 	Profile UbloxProfile // профиль устройства
+	// эфемериды, которые уже есть у устройства и которые не нужно передавать
+	Have []UbloxSatellite
+	// идентификатор устройства для учета запросов к серверам
+	Device string
 }
 
 // Get запрашивает и возвращает данные для инициализации геолокации браслета
 // с помощью сервиса U-Blox.
 func (u *Ublox) Get(req UbloxRequest, data *[]byte) error {
+	result, _, err := u.assemble(req)
+	if err != nil {
+		return err
+	}
+	*data = result
+	return nil
+}
+
+// assemble формирует данные для инициализации по запросу и возвращает их
+// вместе с исходными данными из кеша, по которым они сформированы.
+func (u *Ublox) assemble(req UbloxRequest) (data, source []byte, err error) {
 	if u.client == nil || u.coll == nil {
-		return errors.New("UBLOX: service not initialized")
+		return nil, nil, errors.New("UBLOX: service not initialized")
+	}
+	req, key, filter := u.requestKey(req)
+	// учитываем запрос для фонового обновления популярных данных
+	if u.Refresh != nil {
+		u.Refresh.track(key, req)
+	}
+	cached, err := u.cached(key, req)
+	if err != nil {
+		return nil, nil, err
+	}
+	msgs, err := ParseUBX(cached)
+	if err != nil && err != errUBXEmpty {
+		return nil, nil, err
+	}
+	if filter {
+		msgs = filterVisible(msgs, req.Point, time.Now(), u.ElevationMask,
+			u.VisibilityWindow)
+	}
+	msgs = filterDelta(msgs, req.Have, u.DeltaMaxAge)
+	return MarshalUBX(u.withINI(req, msgs)), cached, nil
+}
+
+// normalize приводит профиль запроса к каноническому виду и возвращает
+// признак фильтрации спутников на сервере. При фильтрации на сервере у
+// внешнего сервиса запрашиваются и кешируются данные по всем спутникам, а
+// фильтрация выполняется для каждого запроса.
+func (u *Ublox) normalize(req UbloxRequest) (UbloxRequest, bool) {
+	req.Profile = req.Profile.canonical()
+	filter := u.LocalFilter && req.Profile.FilterOnPos
+	if filter {
+		req.Profile.FilterOnPos = false
+	}
+	return req, filter
+}
+
+// requestKey приводит запрос к каноническому виду и возвращает его вместе с
+// ключом кеша и признаком фильтрации спутников на сервере. Один и тот же ключ
+// используется при запросе данных и при их предварительной загрузке.
+func (u *Ublox) requestKey(req UbloxRequest) (UbloxRequest, string, bool) {
+	req, filter := u.normalize(req)
+	return req, u.cacheKey(req), filter
+}
+
+// cached возвращает закешированные данные для профиля и координат из запроса.
+// Сначала данные ищутся в кеше в памяти, затем в базе данных, и если их там
+// нет, то запрашиваются у внешнего сервиса.
+func (u *Ublox) cached(key string, req UbloxRequest) ([]byte, error) {
+	if data, ok := u.memory.get(key); ok {
+		return data, nil
 	}
 	// ищем данные в кеш для указанного профиля и координат
 	session := u.coll.Database.Session.Copy()
@@ -58,31 +177,133 @@ func (u *Ublox) Get(req UbloxRequest, data *[]byte) error {
 		"point": bson.D{ // важен порядок следования элементов запроса
 			{"$nearSphere", req.Point},
 			{"$maxDistance", u.MaxDistance},
-		}}
-	filter := bson.M{"data": 1, "_id": 0}
-	var cacheData struct{ Data []byte }
-	err := coll.Find(search).Select(filter).One(&cacheData)
-	if err == nil {
-		*data = cacheData.Data
-		return nil
-	}
-	// данные к кеш не найдены — делаем запрос данных у внешнего сервиса
-	*data, err = u.requestServers(req)
+		},
+		// данные должны покрывать текущее время
+		"expire": bson.M{"$gt": time.Now()},
+	}
+	var cacheData struct {
+		ID     bson.ObjectId `bson:"_id"`
+		Data   compressedData
+		Expire time.Time
+	}
+	err := coll.Find(search).Select(bson.M{"data": 1, "expire": 1}).
+		One(&cacheData)
 	if err != nil {
-		return err
+		// данные к кеш не найдены — делаем запрос данных у внешнего сервиса
+		return u.load(coll, req)
+	}
+	// учитываем количество использований данных из кеша
+	coll.UpdateId(cacheData.ID, bson.M{"$inc": bson.M{"hits": 1}})
+	u.memory.put(key, cacheData.ID, cacheData.Data, cacheData.Expire)
+	return cacheData.Data, nil
+}
+
+// load запрашивает данные у внешнего сервиса, сохраняет их в кеш и возвращает.
+func (u *Ublox) load(coll *mgo.Collection, req UbloxRequest) ([]byte, error) {
+	data, err := u.requestServers(req)
+	if err != nil {
+		return nil, err
+	}
+	// данные уже проверены при получении, поэтому ошибки разбора быть не
+	// может; данные инициализации относятся к конкретному запросу, поэтому
+	// в кеш они не сохраняются
+	msgs, _ := ParseUBX(data)
+	msgs = stripUBXINI(msgs)
+	data = MarshalUBX(msgs)
+	// время жизни данных в кеше определяется временем действия
+	// содержащихся в них эфемерид и альманахов
+	now := time.Now()
+	expire, ok := ubxExpire(msgs, now)
+	if !ok {
+		expire = now.Add(u.CacheTime)
 	}
 	// сохраняем полученные данные в кеш
-	return coll.Insert(struct {
-		Profile UbloxProfile // профиль
-		Point   Point        // координаты
-		Data    []byte       // содержимое ответа
-		Time    time.Time    // временная метка
+	id := bson.NewObjectId()
+	err = coll.Insert(struct {
+		ID      bson.ObjectId  `bson:"_id"`
+		Profile UbloxProfile   // профиль
+		Point   Point          // координаты
+		Data    compressedData // содержимое ответа
+		Size    int            // размер содержимого ответа
+		Summary map[string]int // количество сообщений каждого типа
+		Time    time.Time      // временная метка
+		Expire  time.Time      // время окончания действия данных
 	}{
+		ID:      id,
 		Profile: req.Profile,
 		Point:   req.Point,
-		Data:    *data,
-		Time:    time.Now(),
+		Data:    data,
+		Size:    len(data),
+		Summary: UBXSummary(msgs),
+		Time:    now,
+		Expire:  expire,
 	})
+	if err != nil {
+		return nil, err
+	}
+	u.memory.put(u.cacheKey(req), id, data, expire)
+	return data, nil
+}
+
+// cacheKey возвращает ключ для кеширования данных в памяти, состоящий из
+// профиля в каноническом виде и ячейки geohash, размер которой соответствует
+// максимальной дистанции совпадения.
+func (u *Ublox) cacheKey(req UbloxRequest) string {
+	return req.Profile.key() + ";" +
+		Geohash(req.Point, geohashPrecision(u.MaxDistance))
+}
+
+// close останавливает фоновые задачи сервиса.
+func (u *Ublox) close() {
+	if u.Offline != nil {
+		u.Offline.close()
+	}
+	if u.Refresh != nil {
+		u.Refresh.close()
+	}
+}
+
+// withINI добавляет в начало списка сообщения начальной инициализации с
+// текущим временем сервера и координатами из запроса, если профиль устройства
+// запрашивает данные о положении (pos). Устаревшие данные инициализации, если
+// они есть, из списка удаляются.
+func (u *Ublox) withINI(req UbloxRequest, msgs []UBXMessage) []UBXMessage {
+	msgs = stripUBXINI(msgs)
+	var pos bool
+	for _, datatype := range req.Profile.Datatype {
+		if datatype == "pos" {
+			pos = true
+			break
+		}
+	}
+	if !pos {
+		return msgs
+	}
+	pacc := req.Pacc
+	if pacc == 0 {
+		pacc = u.Pacc
+	}
+	if pacc == 0 {
+		pacc = 300000 // значение по умолчанию сервиса U-Blox
+	}
+	ini := ubxINI(req.Profile.Format, time.Now(), req.Point, pacc)
+	return append(ini, msgs...)
+}
+
+// Summary возвращает количество сообщений каждого типа (AID-EPH, MGA-GPS-EPH и
+// т.д.), содержащихся в данных, которые вернул бы запрос Get с теми же
+// параметрами.
+func (u *Ublox) Summary(req UbloxRequest, summary *map[string]int) error {
+	var data []byte
+	if err := u.Get(req, &data); err != nil {
+		return err
+	}
+	msgs, err := ParseUBX(data)
+	if err != nil {
+		return err
+	}
+	*summary = UBXSummary(msgs)
+	return nil
 }
 
 // requestServers осуществляет запрос к сервису U-Blox, перебирая все доступные
@@ -102,36 +323,17 @@ func (u *Ublox) requestServers(req UbloxRequest) ([]byte, error) {
 		fmt.Fprintf(queryBuf, ";gnss=%s", strings.Join(profile.GNSS, ","))
 	}
 	fmt.Fprintf(queryBuf, ";lon=%f;lat=%f", req.Point[0], req.Point[1])
-	if u.Pacc != 300000 && u.Pacc < 6000000 {
+	if u.Pacc != 300000 && u.Pacc < ubxMaxPacc {
 		fmt.Fprintf(queryBuf, ";pacc=%d", u.Pacc)
 	}
 	if profile.FilterOnPos {
 		queryBuf.WriteString(";filteronpos")
 	}
-	query := queryBuf.String()
-	// перебираем все сервера сервиса по порядку
-	for i, server := range u.Servers {
-		reqURL := fmt.Sprintf("%s?%s", server, query)
-		data, err := u.getData(reqURL)
-		if err == nil {
-			return data, nil
-		}
-		if i == len(u.Servers)-1 {
-			return nil, err // для последнего сервера возвращаем ошибку
-		}
-	}
-	return nil, errors.New("UBLOX: no servers")
+	return u.queryServers(u.Servers, queryBuf.String(), req.Device, checkUBX)
 }
 
-// getData осуществляет запрос к серверу и возвращает данные от него.
-func (u *Ublox) getData(url string) ([]byte, error) {
-	resp, err := u.client.Get(url)
-	if err != nil {
-		return nil, err
-	}
-	defer resp.Body.Close()
-	if resp.StatusCode != 200 {
-		return nil, fmt.Errorf("UBLOX: bad response %s", resp.Status)
-	}
-	return ioutil.ReadAll(resp.Body)
+// checkUBX проверяет, что данные состоят из корректных сообщений UBX.
+func checkUBX(data []byte) error {
+	_, err := ParseUBX(data)
+	return err
 }
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// UbloxCacheFilter описывает условия выбора закешированных данных. Если
+// условия не заданы, то для удаления данных нужно явно указать All.
+type UbloxCacheFilter struct {
+	Profile *UbloxProfile // профиль устройства
+	Center  *Point        // центр области
+	Radius  float64       // радиус области в метрах
+	All     bool          // выбрать все данные
+}
+
+// UbloxCacheEntry описывает закешированные данные.
+type UbloxCacheEntry struct {
+	ID      string         // идентификатор
+	Profile UbloxProfile   // профиль устройства
+	Point   Point          // координаты точки запроса
+	Time    time.Time      // время получения данных
+	Expire  time.Time      // время окончания действия данных
+	Age     time.Duration  // время, прошедшее с получения данных
+	Size    int            // размер данных в байтах
+	Hits    int            // количество использований данных из кеша
+	Summary map[string]int // количество сообщений каждого типа
+}
+
+// UbloxWarmRequest описывает список точек и профилей устройств, для которых
+// нужно заранее загрузить данные в кеш.
+type UbloxWarmRequest struct {
+	Points   []Point        // координаты точек
+	Profiles []UbloxProfile // профили устройств
+}
+
+// query возвращает условие запроса к базе данных.
+func (f UbloxCacheFilter) query() bson.M {
+	query := bson.M{}
+	if f.Profile != nil {
+		query["profile"] = f.Profile.canonical()
+	}
+	if f.Center != nil {
+		query["point"] = bson.M{
+			"$geoWithin": bson.M{
+				"$centerSphere": []interface{}{
+					[2]float64(*f.Center), f.Radius / earthRadius},
+			},
+		}
+	}
+	return query
+}
+
+// list возвращает список закешированных данных, удовлетворяющих условиям.
+// Методы управления кешем не экспортируются, чтобы они были доступны только
+// через HTTP-интерфейс с токеном администратора, а не через RPC.
+func (u *Ublox) list(filter UbloxCacheFilter) ([]UbloxCacheEntry, error) {
+	if u.coll == nil {
+		return nil, errors.New("UBLOX: service not initialized")
+	}
+	session := u.coll.Database.Session.Copy()
+	defer session.Close()
+	coll := session.DB(u.coll.Database.Name).C(u.coll.Name)
+	var entries []struct {
+		ID      bson.ObjectId `bson:"_id"`
+		Profile UbloxProfile
+		Point   Point
+		Size    int
+		Summary map[string]int
+		Time    time.Time
+		Expire  time.Time
+		Hits    int
+	}
+	err := coll.Find(filter.query()).Select(bson.M{"data": 0}).Sort("-time").
+		All(&entries)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	memoryHits := u.memory.entryHits()
+	list := make([]UbloxCacheEntry, 0, len(entries))
+	for _, entry := range entries {
+		list = append(list, UbloxCacheEntry{
+			ID:      entry.ID.Hex(),
+			Profile: entry.Profile,
+			Point:   entry.Point,
+			Time:    entry.Time,
+			Expire:  entry.Expire,
+			Age:     now.Sub(entry.Time),
+			Size:    entry.Size,
+			Hits:    entry.Hits + memoryHits[entry.ID],
+			Summary: entry.Summary,
+		})
+	}
+	return list, nil
+}
+
+// invalidate удаляет из кеша данные, удовлетворяющие условиям, и возвращает
+// количество удаленных записей.
+func (u *Ublox) invalidate(filter UbloxCacheFilter) (int, error) {
+	if u.coll == nil {
+		return 0, errors.New("UBLOX: service not initialized")
+	}
+	query := filter.query()
+	if len(query) == 0 && !filter.All {
+		return 0, errors.New("UBLOX: empty cache filter")
+	}
+	session := u.coll.Database.Session.Copy()
+	defer session.Close()
+	coll := session.DB(u.coll.Database.Name).C(u.coll.Name)
+	if len(query) == 0 {
+		info, err := coll.RemoveAll(nil)
+		if err != nil {
+			return 0, err
+		}
+		u.memory.clear()
+		return info.Removed, nil
+	}
+	var entries []struct {
+		ID bson.ObjectId `bson:"_id"`
+	}
+	err := coll.Find(query).Select(bson.M{"_id": 1}).All(&entries)
+	if err != nil {
+		return 0, err
+	}
+	ids := make(map[bson.ObjectId]bool, len(entries))
+	list := make([]bson.ObjectId, len(entries))
+	for i, entry := range entries {
+		ids[entry.ID] = true
+		list[i] = entry.ID
+	}
+	info, err := coll.RemoveAll(bson.M{"_id": bson.M{"$in": list}})
+	if err != nil {
+		return 0, err
+	}
+	u.memory.drop(ids)
+	return info.Removed, nil
+}
+
+// warm загружает в кеш данные для всех сочетаний указанных точек и профилей,
+// если их там еще нет, и возвращает количество обработанных сочетаний.
+// Запросы приводятся к тому же виду, что и в Get, чтобы данные сохранялись
+// под теми же ключами.
+func (u *Ublox) warm(req UbloxWarmRequest) (int, error) {
+	if u.client == nil || u.coll == nil {
+		return 0, errors.New("UBLOX: service not initialized")
+	}
+	var loaded int
+	for _, profile := range req.Profiles {
+		for _, point := range req.Points {
+			ureq, key, _ := u.requestKey(UbloxRequest{Point: point, Profile: profile})
+			if _, err := u.cached(key, ureq); err != nil {
+				return loaded, err
+			}
+			loaded++
+		}
+	}
+	return loaded, nil
+}
+
+// ubloxAdmin описывает HTTP-интерфейс для управления кешем сервиса U-Blox.
+//
+// GET возвращает список закешированных данных, DELETE удаляет их, а POST с
+// описанием UbloxWarmRequest в формате JSON заранее загружает данные в кеш.
+// Условия выбора данных задаются параметрами запроса format, datatype, gnss,
+// filteronpos (профиль), lon, lat, radius (область) и all. Запросы должны
+// содержать токен администратора в заголовке Authorization.
+type ubloxAdmin struct {
+	ublox *Ublox
+	token string
+}
+
+// ServeHTTP обрабатывает запросы на управление кешем.
+func (a *ubloxAdmin) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	auth := []byte(r.Header.Get("Authorization"))
+	if subtle.ConstantTimeCompare(auth, []byte("Bearer "+a.token)) != 1 {
+		http.Error(w, http.StatusText(http.StatusUnauthorized),
+			http.StatusUnauthorized)
+		return
+	}
+	var (
+		result interface{}
+		err    error
+	)
+	switch r.Method {
+	case "GET":
+		var filter UbloxCacheFilter
+		if filter, err = parseUbloxCacheFilter(r.URL.Query()); err == nil {
+			result, err = a.ublox.list(filter)
+		}
+	case "DELETE":
+		var filter UbloxCacheFilter
+		if filter, err = parseUbloxCacheFilter(r.URL.Query()); err == nil {
+			var removed int
+			removed, err = a.ublox.invalidate(filter)
+			result = map[string]int{"removed": removed}
+		}
+	case "POST":
+		var req UbloxWarmRequest
+		err = json.NewDecoder(r.Body).Decode(&req)
+		r.Body.Close()
+		if err == nil {
+			var loaded int
+			loaded, err = a.ublox.warm(req)
+			result = map[string]int{"loaded": loaded}
+		}
+	default:
+		w.Header().Set("Allow", "GET, POST, DELETE")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed),
+			http.StatusMethodNotAllowed)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+// parseUbloxCacheFilter разбирает условия выбора данных из параметров
+// HTTP-запроса.
+func parseUbloxCacheFilter(query url.Values) (filter UbloxCacheFilter, err error) {
+	_, filter.All = query["all"]
+	if query.Get("format") != "" || query.Get("datatype") != "" ||
+		query.Get("gnss") != "" {
+		// разбор профиля совпадает с разбором запроса данных, но координаты
+		// для профиля не нужны
+		values := make(url.Values, len(query))
+		for key, value := range query {
+			values[key] = value
+		}
+		values.Set("lon", "0")
+		values.Set("lat", "0")
+		req, err := parseUbloxQuery(values)
+		if err != nil {
+			return filter, err
+		}
+		filter.Profile = &req.Profile
+	}
+	if query.Get("lon") != "" || query.Get("lat") != "" {
+		req, err := parseUbloxQuery(query)
+		if err != nil {
+			return filter, err
+		}
+		filter.Center = &req.Point
+		if filter.Radius, err = strconv.ParseFloat(query.Get("radius"), 64); err != nil {
+			return filter, errors.New("bad radius")
+		}
+	}
+	return filter, nil
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestUbloxWarmKey(t *testing.T) {
+	u := &Ublox{
+		LocalFilter: true,
+		memory:      newUbloxMemCache(1 << 20),
+	}
+	point := NewPoint(37.6, 55.7)
+	profile := UbloxProfile{Datatype: []string{"eph"}, FilterOnPos: true}
+	// данные, загруженные при запросе с filteronpos, кешируются без него
+	_, key, filter := u.requestKey(UbloxRequest{Point: point, Profile: profile})
+	if !filter {
+		t.Error("local filter not used")
+	}
+	u.memory.put(key, "", []byte{}, time.Now().Add(time.Hour))
+	// предварительная загрузка того же профиля использует тот же ключ
+	ureq, warmKey, _ := u.requestKey(UbloxRequest{
+		Point:   point,
+		Profile: UbloxProfile{Datatype: []string{"EPH"}, FilterOnPos: true},
+	})
+	if ureq.Profile.FilterOnPos {
+		t.Error("filteronpos not cleared")
+	}
+	if _, ok := u.memory.get(warmKey); !ok || warmKey != key {
+		t.Error("warmed entry not used by Get:", warmKey, key)
+	}
+}
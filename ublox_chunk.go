@@ -0,0 +1,230 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/mgo.v2"
+)
+
+var errUbloxContentExpired = errors.New("UBLOX: content expired")
+
+// UbloxChunkRequest описывает запрос части данных для инициализации
+// геолокации браслета. Если идентификатор набора данных не задан, то данные
+// формируются заново по параметрам запроса, иначе возвращается часть ранее
+// сформированного набора данных.
+type UbloxChunkRequest struct {
+	UbloxRequest        // параметры запроса данных
+	ContentID    string // идентификатор набора данных
+	Index        int    // номер запрашиваемой части, начиная с 0
+	MaxSize      int    // максимальный размер части в байтах
+}
+
+// UbloxChunk описывает часть данных для инициализации геолокации браслета.
+type UbloxChunk struct {
+	ContentID string // идентификатор набора данных
+	Index     int    // номер части
+	Count     int    // общее количество частей
+	Size      int    // общий размер данных
+	Data      []byte // содержимое части
+}
+
+// ubloxContent описывает сохраненный набор данных.
+type ubloxContent struct {
+	ID   string         `bson:"_id"` // идентификатор
+	Data compressedData // содержимое
+	Time time.Time      // время формирования
+}
+
+// GetChunk возвращает часть данных для инициализации геолокации браслета.
+// Данные разбиваются на части по границам сообщений UBX так, чтобы размер
+// каждой части не превышал заданного. Устройство должно запрашивать все части
+// одного набора данных с одним и тем же максимальным размером части.
+func (u *Ublox) GetChunk(req UbloxChunkRequest, chunk *UbloxChunk) error {
+	if u.contents == nil {
+		return errors.New("UBLOX: service not initialized")
+	}
+	if req.MaxSize <= 0 {
+		return errors.New("UBLOX: bad chunk size")
+	}
+	content, err := u.content(req.ContentID, req.UbloxRequest)
+	if err != nil {
+		return err
+	}
+	chunks, err := ubxChunks(content.Data, req.MaxSize)
+	if err != nil {
+		return err
+	}
+	if req.Index < 0 || req.Index >= len(chunks) {
+		return fmt.Errorf("UBLOX: bad chunk index %d", req.Index)
+	}
+	*chunk = UbloxChunk{
+		ContentID: content.ID,
+		Index:     req.Index,
+		Count:     len(chunks),
+		Size:      len(content.Data),
+		Data:      chunks[req.Index],
+	}
+	return nil
+}
+
+// content возвращает ранее сформированный набор данных с указанным
+// идентификатором. Если идентификатор не задан, то набор данных формируется
+// по параметрам запроса и сохраняется.
+func (u *Ublox) content(id string, req UbloxRequest) (*ubloxContent, error) {
+	session := u.contents.Database.Session.Copy()
+	defer session.Close()
+	coll := session.DB(u.contents.Database.Name).C(u.contents.Name)
+	content := new(ubloxContent)
+	if id != "" {
+		err := coll.FindId(id).One(content)
+		if err == mgo.ErrNotFound {
+			return nil, errUbloxContentExpired
+		}
+		if err != nil {
+			return nil, err
+		}
+		return content, nil
+	}
+	data, source, err := u.assemble(req)
+	if err != nil {
+		return nil, err
+	}
+	// сформированные данные содержат текущее время, поэтому идентификатор
+	// вычисляется по исходным данным из кеша и параметрам запроса
+	hash := sha1.New()
+	hash.Write(source)
+	fmt.Fprintf(hash, "%s;%f;%f;%d;%v", req.Profile.canonical().key(),
+		req.Point[0], req.Point[1], req.Pacc, req.Have)
+	content.ID = hex.EncodeToString(hash.Sum(nil))
+	// если такой набор данных уже сформирован, то возвращается он, чтобы не
+	// изменять данные, которые устройство уже загружает частями
+	err = coll.FindId(content.ID).One(content)
+	if err == nil {
+		return content, nil
+	}
+	if err != mgo.ErrNotFound {
+		return nil, err
+	}
+	content.Data = data
+	content.Time = time.Now()
+	if _, err := coll.UpsertId(content.ID, content); err != nil {
+		return nil, err
+	}
+	return content, nil
+}
+
+// ubxChunks разбивает данные на части по границам сообщений UBX так, чтобы
+// размер каждой части не превышал указанного.
+func ubxChunks(data []byte, maxSize int) ([][]byte, error) {
+	msgs, err := ParseUBX(data)
+	if err != nil {
+		return nil, err
+	}
+	chunks := make([][]byte, 0, len(data)/maxSize+1)
+	var start, size int
+	for _, msg := range msgs {
+		if msg.Len() > maxSize {
+			return nil, fmt.Errorf("UBLOX: %s message larger than chunk size",
+				msg.Name())
+		}
+		if size+msg.Len() > maxSize {
+			chunks = append(chunks, data[start:start+size])
+			start += size
+			size = 0
+		}
+		size += msg.Len()
+	}
+	return append(chunks, data[start:start+size]), nil
+}
+
+// ServeHTTP отдает данные для инициализации геолокации браслета по HTTP.
+//
+// Запрос с параметрами lon, lat, pacc, format, datatype, gnss и filteronpos
+// формирует новый набор данных; его идентификатор возвращается в заголовке
+// ETag, а адрес для повторной загрузки — в заголовке Content-Location. По
+// этому адресу набор данных можно загружать частями с помощью заголовка
+// Range, проверяя с помощью If-Range, что данные не изменились.
+func (u *Ublox) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed),
+			http.StatusMethodNotAllowed)
+		return
+	}
+	if u.contents == nil {
+		http.Error(w, http.StatusText(http.StatusServiceUnavailable),
+			http.StatusServiceUnavailable)
+		return
+	}
+	var id string
+	if rest := strings.TrimPrefix(r.URL.Path, u.prefix); rest != "" {
+		id = path.Base(rest)
+	}
+	var req UbloxRequest
+	if id == "" {
+		var err error
+		if req, err = parseUbloxQuery(r.URL.Query()); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	content, err := u.content(id, req)
+	if err == errUbloxContentExpired {
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("ETag", strconv.Quote(content.ID))
+	w.Header().Set("Content-Location", path.Join(u.prefix, content.ID))
+	http.ServeContent(w, r, "", content.Time, bytes.NewReader(content.Data))
+}
+
+// parseUbloxQuery разбирает параметры HTTP-запроса данных.
+func parseUbloxQuery(query url.Values) (req UbloxRequest, err error) {
+	get := query.Get
+	list := func(name string) []string {
+		if value := get(name); value != "" {
+			return strings.Split(value, ",")
+		}
+		return nil
+	}
+	lon, err := strconv.ParseFloat(get("lon"), 64)
+	if err != nil || lon < -180 || lon > 180 {
+		return req, errors.New("bad longitude")
+	}
+	lat, err := strconv.ParseFloat(get("lat"), 64)
+	if err != nil || lat < -90 || lat > 90 {
+		return req, errors.New("bad latitude")
+	}
+	req.Point = NewPoint(lon, lat)
+	if value := get("pacc"); value != "" {
+		pacc, err := strconv.ParseUint(value, 10, 32)
+		if err != nil {
+			return req, errors.New("bad pacc")
+		}
+		req.Pacc = uint32(pacc)
+	}
+	req.Device = get("device")
+	_, filter := query["filteronpos"]
+	req.Profile = UbloxProfile{
+		Datatype:    list("datatype"),
+		Format:      get("format"),
+		GNSS:        list("gnss"),
+		FilterOnPos: filter,
+	}
+	return req, nil
+}
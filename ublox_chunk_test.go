@@ -0,0 +1,37 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestUBXChunks(t *testing.T) {
+	msgs := []UBXMessage{
+		{Class: ubxClassAID, ID: 0x31, Payload: make([]byte, 104)},
+		{Class: ubxClassAID, ID: 0x31, Payload: make([]byte, 8)},
+		{Class: ubxClassAID, ID: 0x31, Payload: make([]byte, 104)},
+		{Class: ubxClassAID, ID: 0x30, Payload: make([]byte, 40)},
+	}
+	data := MarshalUBX(msgs)
+	chunks, err := ubxChunks(data, 128)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(chunks) != 3 {
+		t.Fatalf("%d chunks, want 3", len(chunks))
+	}
+	for _, chunk := range chunks {
+		if len(chunk) > 128 {
+			t.Error("chunk too large:", len(chunk))
+		}
+		if _, err := ParseUBX(chunk); err != nil {
+			t.Error("chunk split inside message:", err)
+		}
+	}
+	if !bytes.Equal(bytes.Join(chunks, nil), data) {
+		t.Error("chunks do not add up to data")
+	}
+	if _, err := ubxChunks(data, 100); err == nil {
+		t.Error("message larger than chunk size accepted")
+	}
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"container/list"
+	"sync"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// UbloxCacheStats описывает статистику использования кеша в памяти.
+type UbloxCacheStats struct {
+	Hits    int64 // количество найденных в кеше данных
+	Misses  int64 // количество ненайденных в кеше данных
+	Entries int   // количество записей в кеше
+	Size    int64 // размер данных в кеше в байтах
+	Budget  int64 // максимальный размер данных в кеше в байтах
+}
+
+// ubloxMemCache описывает кеш данных в памяти, ограниченный по размеру. При
+// превышении размера удаляются данные, которые дольше всего не запрашивались.
+type ubloxMemCache struct {
+	mu     sync.Mutex               // блокировка доступа
+	budget int64                    // максимальный размер данных
+	size   int64                    // текущий размер данных
+	order  *list.List               // записи в порядке использования
+	items  map[string]*list.Element // записи по ключу
+	hits   int64                    // количество найденных данных
+	misses int64                    // количество ненайденных данных
+}
+
+// ubloxMemEntry описывает запись в кеше в памяти.
+type ubloxMemEntry struct {
+	key    string        // ключ
+	id     bson.ObjectId // идентификатор данных в базе данных
+	data   []byte        // данные
+	expire time.Time     // время окончания действия данных
+	hits   int           // количество использований данных из кеша
+}
+
+// newUbloxMemCache возвращает новый кеш в памяти с указанным размером.
+func newUbloxMemCache(budget int64) *ubloxMemCache {
+	return &ubloxMemCache{
+		budget: budget,
+		order:  list.New(),
+		items:  make(map[string]*list.Element),
+	}
+}
+
+// get возвращает данные из кеша. Данные, срок действия которых закончился,
+// удаляются из кеша.
+func (c *ubloxMemCache) get(key string) ([]byte, bool) {
+	if c == nil {
+		return nil, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	elem, ok := c.items[key]
+	if ok && elem.Value.(*ubloxMemEntry).expire.After(time.Now()) {
+		c.order.MoveToFront(elem)
+		c.hits++
+		entry := elem.Value.(*ubloxMemEntry)
+		entry.hits++
+		return entry.data, true
+	}
+	if ok {
+		c.remove(elem)
+	}
+	c.misses++
+	return nil, false
+}
+
+// put сохраняет данные в кеше. Данные, размер которых превышает размер кеша,
+// не сохраняются.
+func (c *ubloxMemCache) put(key string, id bson.ObjectId, data []byte,
+	expire time.Time) {
+	if c == nil || int64(len(data)) > c.budget {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem, ok := c.items[key]; ok {
+		c.remove(elem)
+	}
+	c.items[key] = c.order.PushFront(&ubloxMemEntry{
+		key:    key,
+		id:     id,
+		data:   data,
+		expire: expire,
+	})
+	c.size += int64(len(data))
+	for c.size > c.budget {
+		c.remove(c.order.Back())
+	}
+}
+
+// remove удаляет запись из кеша. Вызывается только при установленной
+// блокировке.
+func (c *ubloxMemCache) remove(elem *list.Element) {
+	entry := c.order.Remove(elem).(*ubloxMemEntry)
+	delete(c.items, entry.key)
+	c.size -= int64(len(entry.data))
+}
+
+// drop удаляет из кеша данные с указанными идентификаторами.
+func (c *ubloxMemCache) drop(ids map[bson.ObjectId]bool) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, elem := range c.items {
+		if ids[elem.Value.(*ubloxMemEntry).id] {
+			c.remove(elem)
+		}
+	}
+}
+
+// clear удаляет из кеша все данные.
+func (c *ubloxMemCache) clear() {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	c.order.Init()
+	c.items = make(map[string]*list.Element)
+	c.size = 0
+	c.mu.Unlock()
+}
+
+// entryHits возвращает количество использований данных из кеша в памяти по
+// идентификаторам данных в базе данных.
+func (c *ubloxMemCache) entryHits() map[bson.ObjectId]int {
+	hits := make(map[bson.ObjectId]int)
+	if c == nil {
+		return hits
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, elem := range c.items {
+		entry := elem.Value.(*ubloxMemEntry)
+		hits[entry.id] += entry.hits
+	}
+	return hits
+}
+
+// stats возвращает статистику использования кеша и, если указано, сбрасывает
+// счетчики.
+func (c *ubloxMemCache) stats(reset bool) UbloxCacheStats {
+	if c == nil {
+		return UbloxCacheStats{}
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	stats := UbloxCacheStats{
+		Hits:    c.hits,
+		Misses:  c.misses,
+		Entries: len(c.items),
+		Size:    c.size,
+		Budget:  c.budget,
+	}
+	if reset {
+		c.hits, c.misses = 0, 0
+	}
+	return stats
+}
+
+// CacheStats возвращает статистику использования кеша в памяти. Если reset
+// равен true, то счетчики найденных и ненайденных данных сбрасываются.
+func (u *Ublox) CacheStats(reset bool, stats *UbloxCacheStats) error {
+	*stats = u.memory.stats(reset)
+	return nil
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestUbloxMemCache(t *testing.T) {
+	cache := newUbloxMemCache(10)
+	expire := time.Now().Add(time.Hour)
+	cache.put("a", "", make([]byte, 4), expire)
+	cache.put("b", "", make([]byte, 4), expire)
+	if _, ok := cache.get("a"); !ok { // "a" становится последним использованным
+		t.Error("a not found")
+	}
+	cache.put("c", "", make([]byte, 4), expire) // вытесняет "b"
+	if _, ok := cache.get("b"); ok {
+		t.Error("b not evicted")
+	}
+	cache.put("d", "", make([]byte, 4), time.Now().Add(-time.Second))
+	if _, ok := cache.get("d"); ok {
+		t.Error("expired data returned")
+	}
+	cache.put("e", "", make([]byte, 11), expire)
+	if _, ok := cache.get("e"); ok {
+		t.Error("data larger than budget cached")
+	}
+	stats := cache.stats(true)
+	if stats.Hits != 1 || stats.Misses != 3 || stats.Size > 10 {
+		t.Errorf("bad stats: %+v", stats)
+	}
+	if stats := cache.stats(false); stats.Hits != 0 || stats.Misses != 0 {
+		t.Errorf("stats not reset: %+v", stats)
+	}
+	var nilCache *ubloxMemCache
+	if _, ok := nilCache.get("a"); ok {
+		t.Error("disabled cache returned data")
+	}
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+const (
+	ubxIDMGAANO byte = 0x20 // MGA-ANO
+
+	ubloxOfflineID    = "offline"        // идентификатор данных в хранилище
+	ubloxOfflineRetry = time.Minute * 10 // интервал повтора при ошибке загрузки
+)
+
+// UbloxOffline описывает настройки периодической загрузки данных сервиса
+// AssistNow Offline.
+type UbloxOffline struct {
+	Servers    []string      // список серверов (GetOfflineData.ashx)
+	GNSS       []string      // список GNSS (gps, glo)
+	Format     string        // формат данных (mga или aid)
+	Period     int           // период в неделях, на который запрашиваются данные (1-5)
+	Resolution int           // интервал в днях между наборами данных (1-3)
+	Interval   time.Duration // интервал между загрузками данных
+
+	coll *mgo.Collection // соединение с MongoDB
+	done chan struct{}   // канал для остановки загрузки
+}
+
+// UbloxOfflineRequest описывает параметры запроса данных AssistNow Offline.
+type UbloxOfflineRequest struct {
+	Date time.Time // текущая дата устройства (если не задана, то текущая)
+	Days int       // количество дней, на которое нужны данные (0 — все)
+}
+
+// ubloxOfflineData описывает сохраненные в базе данные AssistNow Offline.
+type ubloxOfflineData struct {
+	ID     string         `bson:"_id"` // идентификатор
+	Format string         // формат данных
+	Data   compressedData // содержимое ответа
+	Time   time.Time      // время загрузки
+}
+
+// GetOffline возвращает данные AssistNow Offline, необходимые устройству на
+// указанное количество дней, начиная с его текущей даты. Данные в формате aid
+// возвращаются целиком, потому что не разделены на сообщения по дням.
+func (u *Ublox) GetOffline(req UbloxOfflineRequest, data *[]byte) error {
+	if u.client == nil || u.Offline == nil || u.Offline.coll == nil {
+		return errors.New("UBLOX: offline service not initialized")
+	}
+	session := u.Offline.coll.Database.Session.Copy()
+	defer session.Close()
+	coll := session.DB(u.Offline.coll.Database.Name).C(u.Offline.coll.Name)
+	var offline ubloxOfflineData
+	err := coll.FindId(ubloxOfflineID).One(&offline)
+	if err == mgo.ErrNotFound {
+		return errors.New("UBLOX: offline data not loaded yet")
+	}
+	if err != nil {
+		return err
+	}
+	if offline.Format == "aid" {
+		*data = offline.Data
+		return nil
+	}
+	msgs, err := ParseUBX(offline.Data)
+	if err != nil {
+		return err
+	}
+	if req.Date.IsZero() {
+		req.Date = time.Now()
+	}
+	from := req.Date.UTC().Truncate(time.Hour * 24)
+	var to time.Time
+	if req.Days > 0 {
+		to = from.AddDate(0, 0, req.Days)
+	}
+	result := make([]UBXMessage, 0, len(msgs))
+	for _, msg := range msgs {
+		if msg.Class != ubxClassMGA || msg.ID != ubxIDMGAANO ||
+			len(msg.Payload) < 7 {
+			continue
+		}
+		date := time.Date(2000+int(msg.Payload[4]), time.Month(msg.Payload[5]),
+			int(msg.Payload[6]), 0, 0, 0, 0, time.UTC)
+		if date.Before(from) || (!to.IsZero() && !date.Before(to)) {
+			continue
+		}
+		result = append(result, msg)
+	}
+	if len(result) == 0 {
+		return errors.New("UBLOX: no offline data for requested dates")
+	}
+	*data = MarshalUBX(result)
+	return nil
+}
+
+// runOffline периодически загружает данные AssistNow Offline и сохраняет их в
+// хранилище до тех пор, пока не будет закрыт канал done.
+func (u *Ublox) runOffline(done <-chan struct{}) {
+	offline := u.Offline
+	for {
+		// вычисляем время следующей загрузки по времени сохраненных данных
+		var wait time.Duration
+		session := offline.coll.Database.Session.Copy()
+		var stored ubloxOfflineData
+		err := session.DB(offline.coll.Database.Name).C(offline.coll.Name).
+			FindId(ubloxOfflineID).Select(bson.M{"time": 1}).One(&stored)
+		session.Close()
+		if err == nil {
+			wait = stored.Time.Add(offline.Interval).Sub(time.Now())
+		}
+		if wait > 0 {
+			select {
+			case <-done:
+				return
+			case <-time.After(wait):
+			}
+		}
+		if err := u.loadOffline(); err != nil {
+			log.Println("UBLOX: offline data loading error:", err)
+			select {
+			case <-done:
+				return
+			case <-time.After(ubloxOfflineRetry):
+			}
+		}
+	}
+}
+
+// loadOffline загружает данные AssistNow Offline и сохраняет их в хранилище.
+func (u *Ublox) loadOffline() error {
+	offline := u.Offline
+	var queryBuf = new(bytes.Buffer)
+	fmt.Fprintf(queryBuf, "token=%s", u.Token)
+	if offline.Format != "" {
+		fmt.Fprintf(queryBuf, ";format=%s", offline.Format)
+	}
+	if len(offline.GNSS) > 0 {
+		fmt.Fprintf(queryBuf, ";gnss=%s", strings.Join(offline.GNSS, ","))
+	}
+	if offline.Period > 0 {
+		fmt.Fprintf(queryBuf, ";period=%d", offline.Period)
+	}
+	if offline.Resolution > 0 {
+		fmt.Fprintf(queryBuf, ";resolution=%d", offline.Resolution)
+	}
+	check := checkUBX
+	if offline.Format == "aid" {
+		// данные в формате aid не являются сообщениями UBX
+		check = func(data []byte) error {
+			if len(data) == 0 {
+				return errUBXEmpty
+			}
+			return nil
+		}
+	}
+	data, err := u.queryServers(offline.Servers, queryBuf.String(), "", check)
+	if err != nil {
+		return err
+	}
+	session := offline.coll.Database.Session.Copy()
+	defer session.Close()
+	coll := session.DB(offline.coll.Database.Name).C(offline.coll.Name)
+	_, err = coll.UpsertId(ubloxOfflineID, ubloxOfflineData{
+		ID:     ubloxOfflineID,
+		Format: offline.Format,
+		Data:   data,
+		Time:   time.Now(),
+	})
+	return err
+}
+
+// close останавливает периодическую загрузку данных.
+func (o *UbloxOffline) close() {
+	if o.done != nil {
+		close(o.done)
+		o.done = nil
+	}
+}
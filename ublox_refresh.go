@@ -0,0 +1,184 @@
+package main
+
+import (
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// интервал проверки необходимости обновления популярных данных
+const ubloxRefreshInterval = time.Minute
+
+// UbloxRefresh описывает настройки фонового обновления данных для часто
+// запрашиваемых профилей и областей. Данные обновляются незадолго до
+// окончания их действия, чтобы первый запрос после этого не ждал ответа от
+// внешнего сервиса.
+type UbloxRefresh struct {
+	Before     time.Duration // за какое время до окончания действия обновлять данные
+	Budget     int           // максимальное количество обновлений в час
+	MinHits    int           // минимальное количество запросов для обновления
+	MaxRegions int           // максимальное количество отслеживаемых областей (по умолчанию 10000)
+
+	mu     sync.Mutex                 // блокировка доступа к статистике
+	hot    map[string]*ubloxHotRegion // статистика запросов по профилю и ячейке
+	spent  int                        // количество обновлений за текущий час
+	window time.Time                  // время начала текущего часа
+	done   chan struct{}              // канал для остановки обновления
+}
+
+// ubloxHotRegion описывает статистику запросов для профиля и ячейки.
+type ubloxHotRegion struct {
+	req  UbloxRequest // последний запрос для этой ячейки
+	hits int          // количество запросов
+}
+
+// track учитывает запрос в статистике запросов по ключу, состоящему из
+// профиля и ячейки geohash. Если количество отслеживаемых областей достигло
+// MaxRegions, то новая область заменяет наименее популярную, чтобы запросы
+// с постоянно меняющимися координатами не увеличивали статистику без
+// ограничения.
+func (r *UbloxRefresh) track(key string, req UbloxRequest) {
+	r.mu.Lock()
+	if r.hot == nil {
+		r.hot = make(map[string]*ubloxHotRegion)
+	}
+	region := r.hot[key]
+	if region == nil {
+		if r.MaxRegions > 0 && len(r.hot) >= r.MaxRegions {
+			r.evict()
+		}
+		region = new(ubloxHotRegion)
+		r.hot[key] = region
+	}
+	// фоновые запросы не учитываются за устройством
+	region.req = req
+	region.req.Device = ""
+	region.hits++
+	r.mu.Unlock()
+}
+
+// evict удаляет из статистики наименее популярную область. Вызывается при
+// заблокированной статистике.
+func (r *UbloxRefresh) evict() {
+	var (
+		evicted string
+		min     = -1
+	)
+	for key, region := range r.hot {
+		if min < 0 || region.hits < min {
+			evicted, min = key, region.hits
+		}
+	}
+	delete(r.hot, evicted)
+}
+
+// candidates возвращает список запросов для популярных областей, отсортированный
+// по убыванию популярности, и количество обновлений, которое еще можно
+// выполнить в течение текущего часа. Раз в час статистика запросов уменьшается
+// вдвое, чтобы области, которые перестали запрашивать, постепенно выбывали.
+func (r *UbloxRefresh) candidates() ([]UbloxRequest, int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if now := time.Now(); now.Sub(r.window) >= time.Hour {
+		r.window = now
+		r.spent = 0
+		for key, region := range r.hot {
+			if region.hits /= 2; region.hits == 0 {
+				delete(r.hot, key)
+			}
+		}
+	}
+	regions := make([]*ubloxHotRegion, 0, len(r.hot))
+	for _, region := range r.hot {
+		if region.hits >= r.MinHits {
+			regions = append(regions, region)
+		}
+	}
+	sort.Slice(regions, func(i, j int) bool {
+		return regions[i].hits > regions[j].hits
+	})
+	list := make([]UbloxRequest, len(regions))
+	for i, region := range regions {
+		list[i] = region.req
+	}
+	return list, r.Budget - r.spent
+}
+
+// spend учитывает выполненное обновление в бюджете текущего часа.
+func (r *UbloxRefresh) spend() {
+	r.mu.Lock()
+	r.spent++
+	r.mu.Unlock()
+}
+
+// close останавливает фоновое обновление данных.
+func (r *UbloxRefresh) close() {
+	if r.done != nil {
+		close(r.done)
+		r.done = nil
+	}
+}
+
+// runRefresh периодически обновляет данные для популярных областей, срок
+// действия которых скоро закончится, до тех пор, пока не будет закрыт канал
+// done.
+func (u *Ublox) runRefresh(done <-chan struct{}) {
+	ticker := time.NewTicker(ubloxRefreshInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+		u.refresh()
+	}
+}
+
+// refresh обновляет данные для популярных областей в пределах бюджета.
+func (u *Ublox) refresh() {
+	list, budget := u.Refresh.candidates()
+	if len(list) == 0 || budget <= 0 {
+		return
+	}
+	session := u.coll.Database.Session.Copy()
+	defer session.Close()
+	coll := session.DB(u.coll.Database.Name).C(u.coll.Name)
+	for _, req := range list {
+		if budget <= 0 {
+			return
+		}
+		now := time.Now()
+		var cached []struct{ Expire time.Time }
+		err := coll.Find(bson.M{
+			"profile": req.Profile,
+			"point": bson.D{
+				{Name: "$nearSphere", Value: req.Point},
+				{Name: "$maxDistance", Value: u.MaxDistance},
+			},
+			"expire": bson.M{"$gt": now},
+		}).Select(bson.M{"expire": 1, "_id": 0}).All(&cached)
+		if err != nil {
+			log.Println("UBLOX: refresh error:", err)
+			return
+		}
+		var expire time.Time
+		for _, item := range cached {
+			if item.Expire.After(expire) {
+				expire = item.Expire
+			}
+		}
+		// данные еще долго будут действительны
+		if expire.Sub(now) > u.Refresh.Before {
+			continue
+		}
+		if _, err := u.load(coll, req); err != nil {
+			log.Println("UBLOX: refresh error:", err)
+		}
+		u.Refresh.spend()
+		budget--
+	}
+}
@@ -0,0 +1,18 @@
+package main
+
+import "testing"
+
+func TestUbloxRefreshTrack(t *testing.T) {
+	refresh := &UbloxRefresh{MaxRegions: 2}
+	refresh.track("a", UbloxRequest{Device: "1"})
+	refresh.track("a", UbloxRequest{})
+	refresh.track("b", UbloxRequest{})
+	// новая область вытесняет наименее популярную
+	refresh.track("c", UbloxRequest{})
+	if len(refresh.hot) != 2 || refresh.hot["a"] == nil || refresh.hot["b"] != nil {
+		t.Error("bad tracked regions:", refresh.hot)
+	}
+	if refresh.hot["a"].hits != 2 || refresh.hot["a"].req.Device != "" {
+		t.Error("bad region statistics:", refresh.hot["a"])
+	}
+}
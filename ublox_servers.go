@@ -0,0 +1,248 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// коэффициент сглаживания при вычислении средней задержки и доли ошибок
+const ubloxHealthSmoothing = 0.2
+
+// UbloxServerHealth описывает статистику доступности сервера U-Blox.
+type UbloxServerHealth struct {
+	Server    string        // адрес сервера
+	Latency   time.Duration // средняя задержка ответа
+	ErrorRate float64       // средняя доля ошибок (от 0 до 1)
+	Failures  int           // количество ошибок подряд
+	OpenUntil time.Time     // время, до которого сервер пропускается
+}
+
+// ubloxHealth хранит статистику доступности серверов.
+type ubloxHealth struct {
+	mu      sync.Mutex                    // блокировка доступа
+	servers map[string]*UbloxServerHealth // статистика по адресу сервера
+	next    int                           // счетчик для перебора по кругу
+}
+
+// get возвращает статистику для сервера, создавая ее при необходимости.
+// Вызывается только при установленной блокировке.
+func (h *ubloxHealth) get(server string) *UbloxServerHealth {
+	if h.servers == nil {
+		h.servers = make(map[string]*UbloxServerHealth)
+	}
+	stat := h.servers[server]
+	if stat == nil {
+		stat = &UbloxServerHealth{Server: server}
+		h.servers[server] = stat
+	}
+	return stat
+}
+
+// order возвращает список серверов в порядке опроса. Сервера, для которых
+// сработал предохранитель, в список не включаются, если есть хотя бы один
+// доступный сервер.
+func (h *ubloxHealth) order(servers []string, balance string) []string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	list := make([]string, len(servers))
+	copy(list, servers)
+	switch balance {
+	case "latency":
+		// сервера без статистики имеют нулевую задержку и опрашиваются первыми
+		sort.SliceStable(list, func(i, j int) bool {
+			return h.get(list[i]).Latency < h.get(list[j]).Latency
+		})
+	case "roundrobin":
+		if len(list) > 0 {
+			shift := h.next % len(list)
+			list = append(list[shift:], list[:shift]...)
+			h.next++
+		}
+	}
+	now := time.Now()
+	available := list[:0:0]
+	for _, server := range list {
+		if h.get(server).OpenUntil.Before(now) {
+			available = append(available, server)
+		}
+	}
+	if len(available) == 0 {
+		return list
+	}
+	return available
+}
+
+// report учитывает результат запроса к серверу в статистике. После указанного
+// количества ошибок подряд сервер пропускается в течение времени cooldown.
+func (h *ubloxHealth) report(server string, latency time.Duration, err error,
+	breakerErrors int, cooldown time.Duration) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	stat := h.get(server)
+	var failure float64
+	if err != nil {
+		failure = 1
+		stat.Failures++
+		if breakerErrors > 0 && stat.Failures >= breakerErrors {
+			stat.OpenUntil = time.Now().Add(cooldown)
+		}
+	} else {
+		stat.Failures = 0
+		stat.OpenUntil = time.Time{}
+		if stat.Latency == 0 {
+			stat.Latency = latency
+		} else {
+			stat.Latency += time.Duration(ubloxHealthSmoothing *
+				float64(latency-stat.Latency))
+		}
+	}
+	stat.ErrorRate += ubloxHealthSmoothing * (failure - stat.ErrorRate)
+}
+
+// list возвращает копию статистики по всем серверам.
+func (h *ubloxHealth) list() []UbloxServerHealth {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	list := make([]UbloxServerHealth, 0, len(h.servers))
+	for _, stat := range h.servers {
+		list = append(list, *stat)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Server < list[j].Server
+	})
+	return list
+}
+
+// Health возвращает статистику доступности серверов U-Blox. Если адрес
+// сервера не указан, то возвращается статистика по всем серверам.
+func (u *Ublox) Health(server string, list *[]UbloxServerHealth) error {
+	for _, stat := range u.health.list() {
+		if server == "" || stat.Server == server {
+			*list = append(*list, stat)
+		}
+	}
+	return nil
+}
+
+// queryServers осуществляет запрос с указанными параметрами, перебирая
+// сервера в порядке, заданном настройкой Balance, и возвращает данные от
+// первого сервера, ответ которого прошел проверку. Если задана настройка
+// Hedge и первый сервер не ответил за это время, то параллельно
+// запрашивается следующий сервер. Общее время опроса всех серверов
+// ограничено настройкой Timeout. Каждая попытка учитывается как запрос
+// устройства device; при превышении ограничений запрос не выполняется.
+func (u *Ublox) queryServers(servers []string, query, device string,
+	check func([]byte) error) ([]byte, error) {
+	order := u.health.order(servers, u.Balance)
+	if len(order) == 0 {
+		return nil, errors.New("UBLOX: no servers")
+	}
+	if err := u.usage.allow("ublox", u.Token); err != nil {
+		return nil, fmt.Errorf("UBLOX: %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), u.Timeout)
+	defer cancel() // прерываем оставшиеся параллельные запросы
+	type result struct {
+		data []byte
+		err  error
+	}
+	results := make(chan result, len(order))
+	var next, running int
+	start := func() {
+		server := order[next]
+		next++
+		running++
+		go func() {
+			data, err := u.attempt(ctx, server, query, device, check)
+			results <- result{data, err}
+		}()
+	}
+	start()
+	var lastErr error
+	for running > 0 {
+		var timer *time.Timer
+		var hedge <-chan time.Time
+		if u.Hedge > 0 && running == 1 && next < len(order) {
+			timer = time.NewTimer(u.Hedge)
+			hedge = timer.C
+		}
+		select {
+		case res := <-results:
+			running--
+			if res.err == nil {
+				return res.data, nil
+			}
+			lastErr = res.err
+			// после истечения общего времени оставшиеся сервера не
+			// опрашиваются
+			if running == 0 && next < len(order) && ctx.Err() == nil {
+				start()
+			}
+		case <-hedge:
+			if ctx.Err() == nil {
+				start()
+			}
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+	}
+	return nil, lastErr // возвращаем ошибку последнего сервера
+}
+
+// attempt запрашивает данные у сервера с учетом ограничения времени одной
+// попытки и учитывает результат в статистике доступности сервера и запрос в
+// статистике использования.
+func (u *Ublox) attempt(parent context.Context, server, query, device string,
+	check func([]byte) error) ([]byte, error) {
+	u.usage.record("ublox", u.Token, device)
+	ctx := parent
+	if u.AttemptTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(parent, u.AttemptTimeout)
+		defer cancel()
+	}
+	started := time.Now()
+	data, err := u.getData(ctx, fmt.Sprintf("%s?%s", server, query), check)
+	// прерванные параллельные запросы и запросы, не успевшие до истечения
+	// общего времени, в статистике не учитываются: сервер отвечает за
+	// ошибку, только если истекло время самой попытки
+	if parent.Err() == nil {
+		u.health.report(server, time.Since(started), err,
+			u.BreakerErrors, u.BreakerCooldown)
+	}
+	return data, err
+}
+
+// getData осуществляет запрос к серверу и возвращает данные от него.
+// Полученные данные проверяются с помощью функции check: пустой ответ,
+// страница с описанием ошибки или обрезанные данные считаются ошибкой, чтобы
+// можно было обратиться к следующему серверу.
+func (u *Ublox) getData(ctx context.Context, url string,
+	check func([]byte) error) ([]byte, error) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := u.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("UBLOX: bad response %s", resp.Status)
+	}
+	data, err := readLimited(resp.Body, u.MaxResponseSize)
+	if err != nil {
+		return nil, fmt.Errorf("UBLOX: %v", err)
+	}
+	if err := check(data); err != nil {
+		return nil, fmt.Errorf("UBLOX: bad response data: %v", err)
+	}
+	return data, nil
+}
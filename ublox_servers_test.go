@@ -0,0 +1,75 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestUbloxHealth(t *testing.T) {
+	servers := []string{"a", "b", "c"}
+	var health ubloxHealth
+	health.report("a", time.Second, nil, 2, time.Minute)
+	health.report("b", time.Millisecond, nil, 2, time.Minute)
+	health.report("c", time.Millisecond*10, nil, 2, time.Minute)
+	if order := health.order(servers, "latency"); !reflect.DeepEqual(order,
+		[]string{"b", "c", "a"}) {
+		t.Error("bad latency order:", order)
+	}
+	if order := health.order(servers, "roundrobin"); order[0] != "a" {
+		t.Error("bad round-robin order:", order)
+	}
+	if order := health.order(servers, "roundrobin"); order[0] != "b" {
+		t.Error("bad round-robin order:", order)
+	}
+	// после двух ошибок подряд сервер пропускается
+	health.report("a", 0, errors.New("error"), 2, time.Minute)
+	if order := health.order(servers, ""); len(order) != 3 {
+		t.Error("server skipped after one error:", order)
+	}
+	health.report("a", 0, errors.New("error"), 2, time.Minute)
+	if order := health.order(servers, ""); !reflect.DeepEqual(order,
+		[]string{"b", "c"}) {
+		t.Error("broken server not skipped:", order)
+	}
+	// если недоступны все сервера, то опрашиваются все
+	if order := health.order([]string{"a"}, ""); len(order) != 1 {
+		t.Error("no servers when all broken:", order)
+	}
+}
+
+func TestUbloxQueryServersTimeout(t *testing.T) {
+	slow := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			time.Sleep(time.Millisecond * 200)
+		}))
+	defer slow.Close()
+	var contacted int32
+	other := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			atomic.StoreInt32(&contacted, 1)
+		}))
+	defer other.Close()
+	u := &Ublox{
+		Timeout: time.Millisecond * 50,
+		client:  &http.Client{},
+	}
+	servers := []string{slow.URL, other.URL}
+	if _, err := u.queryServers(servers, "", "", checkUBX); err == nil {
+		t.Fatal("expected timeout error")
+	}
+	// после истечения общего времени сервера не опрашиваются и не
+	// считаются недоступными
+	if atomic.LoadInt32(&contacted) != 0 {
+		t.Error("server contacted after timeout")
+	}
+	for _, stat := range u.health.list() {
+		if stat.Failures > 0 {
+			t.Error("failure reported after overall timeout:", stat.Server)
+		}
+	}
+}
@@ -0,0 +1,343 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// UbloxSimulator описывает имитацию сервиса U-blox AssistNow Online для
+// тестирования без доступа к серверам U-blox. Он разбирает те же параметры
+// запроса, что формирует сервис U-Blox, проверяет их и возвращает корректные
+// сообщения UBX, которые зависят только от параметров запроса и времени.
+//
+// Для проверки обработки ошибок можно задать задержку ответа, долю ответов с
+// ошибкой и долю ответов с поврежденными данными. Ошибки выбираются
+// псевдослучайно, но их последовательность определяется значением Seed.
+type UbloxSimulator struct {
+	Token       string        // токен; если не задан, то подходит любой
+	Time        time.Time     // время формирования данных; по умолчанию текущее
+	Latency     time.Duration // задержка ответа
+	ErrorStatus int           // код ответа с ошибкой; по умолчанию 503
+	ErrorRate   float64       // доля ответов с ошибкой (от 0 до 1)
+	CorruptRate float64       // доля ответов с поврежденными данными (от 0 до 1)
+	Seed        int64         // начальное значение для выбора ошибок
+
+	mu       sync.Mutex // блокировка доступа к генератору случайных чисел
+	rand     *rand.Rand // генератор для выбора ошибок
+	requests int        // количество обработанных запросов
+}
+
+// ubloxSimQuery описывает разобранные параметры запроса к имитации сервиса.
+type ubloxSimQuery struct {
+	format   string
+	datatype map[string]bool
+	gnss     map[string]bool
+	point    Point
+	pacc     uint32
+}
+
+// ServeHTTP обрабатывает запрос данных AssistNow Online.
+func (s *UbloxSimulator) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	fail, corrupt := s.next()
+	if s.Latency > 0 {
+		select {
+		case <-time.After(s.Latency):
+		case <-r.Context().Done():
+			return
+		}
+	}
+	if fail {
+		status := s.ErrorStatus
+		if status == 0 {
+			status = http.StatusServiceUnavailable
+		}
+		http.Error(w, http.StatusText(status), status)
+		return
+	}
+	query, err := s.parse(r.URL.RawQuery)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	now := s.Time
+	if now.IsZero() {
+		now = time.Now()
+	}
+	data := MarshalUBX(query.messages(now))
+	if corrupt && len(data) > 0 {
+		data[len(data)-1] ^= 0xFF // портим контрольную сумму
+	}
+	w.Header().Set("Content-Type", "application/ubx")
+	w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	w.Write(data)
+}
+
+// next учитывает запрос и определяет, нужно ли вернуть на него ошибку или
+// поврежденные данные.
+func (s *UbloxSimulator) next() (fail, corrupt bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.rand == nil {
+		s.rand = rand.New(rand.NewSource(s.Seed))
+	}
+	s.requests++
+	fail = s.rand.Float64() < s.ErrorRate
+	corrupt = s.rand.Float64() < s.CorruptRate
+	return
+}
+
+// Requests возвращает количество обработанных запросов.
+func (s *UbloxSimulator) Requests() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.requests
+}
+
+// parse разбирает и проверяет параметры запроса. Параметры разделяются точкой
+// с запятой, как в запросах к серверам U-blox.
+func (s *UbloxSimulator) parse(rawQuery string) (*ubloxSimQuery, error) {
+	params := make(map[string]string)
+	for _, param := range strings.Split(rawQuery, ";") {
+		if param == "" {
+			continue
+		}
+		kv := strings.SplitN(param, "=", 2)
+		if len(kv) == 1 {
+			kv = append(kv, "")
+		}
+		if _, ok := params[kv[0]]; ok {
+			return nil, fmt.Errorf("duplicate parameter %s", kv[0])
+		}
+		params[kv[0]] = kv[1]
+	}
+	query := &ubloxSimQuery{
+		format:   "mga",
+		datatype: make(map[string]bool),
+		gnss:     make(map[string]bool),
+		pacc:     300000,
+	}
+	for key, value := range params {
+		switch key {
+		case "token":
+			if s.Token != "" && value != s.Token {
+				return nil, errors.New("invalid token")
+			}
+		case "format":
+			if value != "mga" && value != "aid" {
+				return nil, fmt.Errorf("bad format %q", value)
+			}
+			query.format = value
+		case "datatype":
+			for _, name := range strings.Split(value, ",") {
+				switch name {
+				case "eph", "alm", "aux", "pos":
+					query.datatype[name] = true
+				default:
+					return nil, fmt.Errorf("bad datatype %q", name)
+				}
+			}
+		case "gnss":
+			for _, name := range strings.Split(value, ",") {
+				switch name {
+				case "gps", "qzss", "glo", "bds", "gal":
+					query.gnss[name] = true
+				default:
+					return nil, fmt.Errorf("bad gnss %q", name)
+				}
+			}
+		case "lon", "lat":
+			coord, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				return nil, fmt.Errorf("bad %s", key)
+			}
+			if key == "lon" {
+				query.point[0] = coord
+			} else {
+				query.point[1] = coord
+			}
+		case "pacc":
+			pacc, err := strconv.ParseUint(value, 10, 32)
+			if err != nil || pacc > 6000000 {
+				return nil, errors.New("bad pacc")
+			}
+			query.pacc = uint32(pacc)
+		case "filteronpos":
+		default:
+			return nil, fmt.Errorf("unknown parameter %s", key)
+		}
+	}
+	if _, ok := params["token"]; !ok && s.Token != "" {
+		return nil, errors.New("no token")
+	}
+	lon, lonOK := params["lon"]
+	lat, latOK := params["lat"]
+	if !lonOK || !latOK || lon == "" || lat == "" {
+		return nil, errors.New("no position")
+	}
+	if query.point[0] < -180 || query.point[0] > 180 ||
+		query.point[1] < -90 || query.point[1] > 90 {
+		return nil, errors.New("bad position")
+	}
+	if len(query.datatype) == 0 {
+		query.datatype["eph"] = true
+		query.datatype["alm"] = true
+		query.datatype["aux"] = true
+		query.datatype["pos"] = true
+	}
+	if len(query.gnss) == 0 {
+		query.gnss["gps"] = true
+	}
+	return query, nil
+}
+
+// ubloxSimGNSS содержит номера групп сообщений MGA и количество спутников для
+// поддерживаемых систем в порядке их передачи.
+var ubloxSimGNSS = []struct {
+	name       string
+	id         byte // номер группы сообщений MGA
+	satellites int  // количество спутников
+	ephSize    int  // размер сообщения с эфемеридами
+	almSize    int  // размер сообщения с альманахом
+}{
+	{"gps", 0x00, 32, 68, 36},
+	{"gal", 0x02, 24, 76, 32},
+	{"bds", 0x03, 35, 88, 40},
+	{"qzss", 0x05, 4, 68, 36},
+	{"glo", 0x06, 24, 48, 36},
+}
+
+// messages возвращает сообщения с данными, сформированными на указанное время.
+// Формат aid поддерживает только GPS.
+func (q *ubloxSimQuery) messages(now time.Time) []UBXMessage {
+	var msgs []UBXMessage
+	if q.datatype["pos"] {
+		msgs = append(msgs, ubxINI(q.format, now, q.point, q.pacc)...)
+	}
+	for _, gnss := range ubloxSimGNSS {
+		if !q.gnss[gnss.name] || (q.format == "aid" && gnss.name != "gps") {
+			continue
+		}
+		for sv := 1; sv <= gnss.satellites; sv++ {
+			if q.datatype["eph"] {
+				msgs = append(msgs, simEphemeris(q.format, gnss.id, sv,
+					gnss.ephSize, now))
+			}
+		}
+		for sv := 1; sv <= gnss.satellites; sv++ {
+			if q.datatype["alm"] {
+				msgs = append(msgs, simAlmanac(q.format, gnss.id, sv, gnss.almSize))
+			}
+		}
+		if q.datatype["aux"] {
+			msgs = append(msgs, simAux(q.format, gnss.id)...)
+		}
+	}
+	return msgs
+}
+
+// simOrbit возвращает параметры условной круговой орбиты спутника GPS:
+// спутники равномерно распределены по шести орбитальным плоскостям.
+func simOrbit(sv int) (omega0, m0 float64) {
+	plane, slot := (sv-1)%6, (sv-1)/6
+	omega0 = float64(plane)*math.Pi/3 - math.Pi
+	m0 = float64(slot)*math.Pi/3 + float64(plane)*math.Pi/18 - math.Pi
+	return omega0, m0
+}
+
+// simEphemeris возвращает сообщение с эфемеридами спутника. Опорное время
+// эфемерид выбирается на начало следующего часа.
+func simEphemeris(format string, gnssID byte, sv, size int,
+	now time.Time) UBXMessage {
+	le := binary.LittleEndian
+	_, tow := gpsTime(now)
+	toe := uint32((tow.Truncate(time.Hour) + time.Hour) % (time.Hour * 24 * 7) /
+		time.Second / 16)
+	iode := uint32(toe/225) & 0xFF // меняется каждый час
+	omega0, m0 := simOrbit(sv)
+	semicircles := func(rad float64) uint32 {
+		return uint32(int32(rad / math.Pi * (1 << 31)))
+	}
+	sqrtA := uint32(5153.5 * (1 << 19))
+	i0 := semicircles(55 * math.Pi / 180) // наклонение орбиты
+	if format == "aid" {
+		payload := make([]byte, 104)
+		le.PutUint32(payload[0:], uint32(sv))
+		le.PutUint32(payload[4:], 1) // эфемериды присутствуют
+		// слова подкадров содержат по 24 бита данных; биты нумеруются с 1,
+		// начиная со старшего
+		put := func(subframe, n, start, length int, value uint32) {
+			offset := 8 + (subframe-1)*32 + (n-3)*4
+			word := le.Uint32(payload[offset:])
+			word |= (value & (1<<uint(length) - 1)) << uint(25-start-length)
+			le.PutUint32(payload[offset:], word)
+		}
+		m0s, omega0s := semicircles(m0), semicircles(omega0)
+		put(1, 8, 1, 8, iode) // IODC
+		put(2, 3, 1, 8, iode)
+		put(2, 4, 17, 8, m0s>>24)
+		put(2, 5, 1, 24, m0s)
+		put(2, 8, 17, 8, sqrtA>>24)
+		put(2, 9, 1, 24, sqrtA)
+		put(2, 10, 1, 16, toe)
+		put(3, 3, 17, 8, omega0s>>24)
+		put(3, 4, 1, 24, omega0s)
+		put(3, 5, 17, 8, i0>>24)
+		put(3, 6, 1, 24, i0)
+		put(3, 10, 1, 8, iode)
+		return UBXMessage{Class: ubxClassAID, ID: ubxIDAIDEPH, Payload: payload}
+	}
+	payload := make([]byte, size)
+	payload[0] = 0x01 // тип: EPH
+	payload[2] = byte(sv)
+	if gnssID == 0x00 || gnssID == 0x05 { // GPS и QZSS
+		le.PutUint16(payload[8:], uint16(iode))
+		le.PutUint32(payload[24:], semicircles(m0))
+		le.PutUint32(payload[36:], sqrtA)
+		le.PutUint16(payload[40:], uint16(toe))
+		le.PutUint32(payload[44:], semicircles(omega0))
+		le.PutUint32(payload[52:], i0)
+	} else if gnssID == 0x02 { // Galileo
+		le.PutUint16(payload[4:], uint16(iode))
+	}
+	return UBXMessage{Class: ubxClassMGA, ID: gnssID, Payload: payload}
+}
+
+// simAlmanac возвращает сообщение с альманахом спутника.
+func simAlmanac(format string, gnssID byte, sv, size int) UBXMessage {
+	if format == "aid" {
+		payload := make([]byte, 40)
+		binary.LittleEndian.PutUint32(payload[0:], uint32(sv))
+		return UBXMessage{Class: ubxClassAID, ID: ubxIDAIDALM, Payload: payload}
+	}
+	payload := make([]byte, size)
+	payload[0] = 0x02 // тип: ALM
+	payload[2] = byte(sv)
+	return UBXMessage{Class: ubxClassMGA, ID: gnssID, Payload: payload}
+}
+
+// simAux возвращает вспомогательные сообщения (параметры ионосферы и UTC).
+func simAux(format string, gnssID byte) []UBXMessage {
+	if format == "aid" {
+		return []UBXMessage{{Class: ubxClassAID, ID: 0x02, Payload: make([]byte, 72)}}
+	}
+	var msgs []UBXMessage
+	if gnssID == 0x00 || gnssID == 0x03 {
+		iono := make([]byte, 16)
+		iono[0] = 0x06 // тип: IONO
+		msgs = append(msgs, UBXMessage{Class: ubxClassMGA, ID: gnssID, Payload: iono})
+	}
+	if gnssID == 0x00 || gnssID == 0x02 || gnssID == 0x03 {
+		utc := make([]byte, 20)
+		utc[0] = 0x05 // тип: UTC
+		msgs = append(msgs, UBXMessage{Class: ubxClassMGA, ID: gnssID, Payload: utc})
+	}
+	return msgs
+}
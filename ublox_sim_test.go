@@ -0,0 +1,85 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestUbloxSimulator(t *testing.T) {
+	now := time.Date(2016, time.October, 9, 12, 0, 0, 0, time.UTC)
+	simulator := &UbloxSimulator{Token: "test", Time: now}
+	server := httptest.NewServer(simulator)
+	defer server.Close()
+
+	get := func(query string) (int, []byte) {
+		resp, err := http.Get(server.URL + "?" + query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		data, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp.StatusCode, data
+	}
+
+	for _, format := range []string{"aid", "mga"} {
+		status, data := get("token=test;format=" + format +
+			";datatype=eph,pos;gnss=gps;lon=37.600000;lat=55.700000;filteronpos")
+		if status != http.StatusOK {
+			t.Fatalf("%s: status %d: %s", format, status, data)
+		}
+		msgs, err := ParseUBX(data)
+		if err != nil {
+			t.Fatal(format, err)
+		}
+		if !isUBXINI(msgs[0]) {
+			t.Error(format, "no INI message")
+		}
+		if expire, ok := ubxExpire(msgs, now); !ok || !expire.After(now.Add(time.Hour*2)) {
+			t.Error(format, "bad expire:", expire, ok)
+		}
+		visible := filterVisible(stripUBXINI(msgs), NewPoint(37.6, 55.7), now, 5, 0)
+		if len(visible) == 0 || len(visible) >= len(msgs)-1 {
+			t.Errorf("%s: %d of %d satellites visible", format, len(visible), len(msgs)-1)
+		}
+	}
+
+	for _, query := range []string{
+		"format=mga;lon=0;lat=0",                   // нет токена
+		"token=bad;lon=0;lat=0",                    // неверный токен
+		"token=test;gnss=gps,xxx;lon=0;lat=0",      // неизвестная система
+		"token=test;lon=0",                         // нет широты
+		"token=test;lon=0;lat=91",                  // неверная широта
+		"token=test;lon=0;lat=0;datatype=eph;xx=1", // неизвестный параметр
+	} {
+		if status, _ := get(query); status != http.StatusBadRequest {
+			t.Errorf("%s: status %d", query, status)
+		}
+	}
+
+	simulator.CorruptRate = 1
+	if _, data := get("token=test;lon=0;lat=0"); checkUBX(data) == nil {
+		t.Error("data not corrupted")
+	}
+	simulator.CorruptRate, simulator.ErrorRate = 0, 1
+	if status, _ := get("token=test;lon=0;lat=0"); status != http.StatusServiceUnavailable {
+		t.Error("bad error status:", status)
+	}
+	if simulator.Requests() != 10 {
+		t.Error("bad requests count:", simulator.Requests())
+	}
+}
+
+func TestUbloxSimulatorAnyToken(t *testing.T) {
+	simulator := new(UbloxSimulator)
+	for _, query := range []string{"token=;lon=0;lat=0", "token=x;lon=0;lat=0"} {
+		if _, err := simulator.parse(query); err != nil {
+			t.Errorf("%s: %v", query, err)
+		}
+	}
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Классы сообщений UBX, которые встречаются в ответах сервиса AssistNow.
+const (
+	ubxClassAID byte = 0x0B // вспомогательные данные для u7 и более ранних
+	ubxClassMGA byte = 0x13 // вспомогательные данные для M8 и более поздних
+)
+
+var (
+	errUBXEmpty    = errors.New("UBX: empty data")
+	errUBXSync     = errors.New("UBX: bad sync chars")
+	errUBXShort    = errors.New("UBX: truncated message")
+	errUBXChecksum = errors.New("UBX: bad checksum")
+)
+
+// UBXMessage описывает сообщение в формате протокола UBX.
+type UBXMessage struct {
+	Class   byte   // класс сообщения
+	ID      byte   // идентификатор сообщения
+	Payload []byte // содержимое сообщения
+}
+
+// Len возвращает длину сообщения вместе с заголовком и контрольной суммой.
+func (m UBXMessage) Len() int {
+	return len(m.Payload) + 8
+}
+
+// AppendTo добавляет бинарное представление сообщения к данным и возвращает
+// получившийся результат.
+func (m UBXMessage) AppendTo(data []byte) []byte {
+	start := len(data)
+	data = append(data, 0xB5, 0x62, m.Class, m.ID,
+		byte(len(m.Payload)), byte(len(m.Payload)>>8))
+	data = append(data, m.Payload...)
+	a, b := ubxChecksum(data[start+2:])
+	return append(data, a, b)
+}
+
+// Name возвращает название сообщения в нотации u-blox, например AID-EPH или
+// MGA-GPS-EPH. Для сообщений MGA учитывается тип, заданный первым байтом
+// содержимого.
+func (m UBXMessage) Name() string {
+	switch m.Class {
+	case ubxClassAID:
+		if name, ok := ubxAIDNames[m.ID]; ok {
+			return "AID-" + name
+		}
+	case ubxClassMGA:
+		group, ok := ubxMGANames[m.ID]
+		if !ok {
+			break
+		}
+		name := "MGA-" + group.name
+		if group.types == nil || len(m.Payload) == 0 {
+			return name
+		}
+		if typeName, ok := group.types[m.Payload[0]]; ok {
+			return name + "-" + typeName
+		}
+		return fmt.Sprintf("%s-0x%02X", name, m.Payload[0])
+	}
+	return fmt.Sprintf("0x%02X-0x%02X", m.Class, m.ID)
+}
+
+// ubxAIDNames содержит названия сообщений класса AID.
+var ubxAIDNames = map[byte]string{
+	0x01: "INI",
+	0x02: "HUI",
+	0x10: "DATA",
+	0x30: "ALM",
+	0x31: "EPH",
+	0x32: "ALPSRV",
+	0x33: "AOP",
+	0x50: "ALP",
+}
+
+// ubxMGANames содержит названия групп сообщений класса MGA и названия типов
+// сообщений внутри группы.
+var ubxMGANames = map[byte]struct {
+	name  string
+	types map[byte]string
+}{
+	0x00: {"GPS", map[byte]string{
+		0x01: "EPH", 0x02: "ALM", 0x04: "HEALTH", 0x05: "UTC", 0x06: "IONO"}},
+	0x02: {"GAL", map[byte]string{
+		0x01: "EPH", 0x02: "ALM", 0x03: "TIMEOFFSET", 0x05: "UTC"}},
+	0x03: {"BDS", map[byte]string{
+		0x01: "EPH", 0x02: "ALM", 0x04: "HEALTH", 0x05: "UTC", 0x06: "IONO"}},
+	0x05: {"QZSS", map[byte]string{
+		0x01: "EPH", 0x02: "ALM", 0x04: "HEALTH"}},
+	0x06: {"GLO", map[byte]string{
+		0x01: "EPH", 0x02: "ALM", 0x03: "TIMEOFFSET"}},
+	0x20: {"ANO", nil},
+	0x40: {"INI", map[byte]string{
+		0x00: "POS_XYZ", 0x01: "POS_LLH", 0x10: "TIME_UTC", 0x11: "TIME_GNSS",
+		0x20: "CLKD", 0x21: "FREQ", 0x30: "EOP"}},
+	0x60: {"ACK", nil},
+	0x80: {"DBD", nil},
+}
+
+// ubxChecksum вычисляет контрольную сумму Флетчера для сообщения UBX. Данные
+// передаются начиная с класса сообщения и заканчивая его содержимым.
+func ubxChecksum(data []byte) (a, b byte) {
+	for _, c := range data {
+		a += c
+		b += a
+	}
+	return
+}
+
+// ParseUBX разбирает данные в формате UBX и возвращает список сообщений.
+// Если данные пустые, содержат что-то кроме сообщений UBX, обрезаны или
+// контрольная сумма какого-либо из сообщений не совпадает, то возвращается
+// ошибка.
+func ParseUBX(data []byte) ([]UBXMessage, error) {
+	if len(data) == 0 {
+		return nil, errUBXEmpty
+	}
+	msgs := make([]UBXMessage, 0, 64)
+	for offset := 0; offset < len(data); {
+		rest := data[offset:]
+		if len(rest) < 8 {
+			return nil, errUBXShort
+		}
+		if rest[0] != 0xB5 || rest[1] != 0x62 {
+			return nil, errUBXSync
+		}
+		length := int(rest[4]) | int(rest[5])<<8
+		if len(rest) < length+8 {
+			return nil, errUBXShort
+		}
+		a, b := ubxChecksum(rest[2 : length+6])
+		if rest[length+6] != a || rest[length+7] != b {
+			return nil, errUBXChecksum
+		}
+		msgs = append(msgs, UBXMessage{
+			Class:   rest[2],
+			ID:      rest[3],
+			Payload: rest[6 : length+6],
+		})
+		offset += length + 8
+	}
+	return msgs, nil
+}
+
+// MarshalUBX возвращает бинарное представление списка сообщений UBX.
+func MarshalUBX(msgs []UBXMessage) []byte {
+	var size int
+	for _, msg := range msgs {
+		size += msg.Len()
+	}
+	data := make([]byte, 0, size)
+	for _, msg := range msgs {
+		data = msg.AppendTo(data)
+	}
+	return data
+}
+
+// UBXSummary возвращает количество сообщений каждого типа в списке.
+func UBXSummary(msgs []UBXMessage) map[string]int {
+	summary := make(map[string]int)
+	for _, msg := range msgs {
+		summary[msg.Name()]++
+	}
+	return summary
+}
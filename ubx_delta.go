@@ -0,0 +1,80 @@
+package main
+
+import (
+	"encoding/binary"
+	"strings"
+	"time"
+)
+
+// UbloxSatellite описывает эфемериды спутника, которые уже есть у устройства.
+type UbloxSatellite struct {
+	GNSS string        // система (gps, qzss, glo, gal, bds)
+	SV   int           // номер спутника
+	IODE int           // идентификатор набора данных эфемерид
+	Age  time.Duration // время, прошедшее с получения эфемерид
+}
+
+// ubxEphemerisID возвращает систему, номер спутника и идентификатор набора
+// данных для сообщения с эфемеридами. Если идентификатор набора данных для
+// системы не разбирается, то возвращается -1. Для сообщений без эфемерид
+// возвращается false.
+func ubxEphemerisID(msg UBXMessage) (gnss string, sv, iode int, ok bool) {
+	p := msg.Payload
+	switch name := msg.Name(); name {
+	case "AID-EPH":
+		if len(p) != 104 { // эфемериды для спутника отсутствуют
+			return "", 0, 0, false
+		}
+		eph, _ := parseGPSEphemeris(msg)
+		return "gps", eph.SV, eph.IODE, true
+	case "MGA-GPS-EPH", "MGA-QZSS-EPH":
+		if eph, ok := parseGPSEphemeris(msg); ok {
+			gnss = strings.ToLower(strings.Split(name, "-")[1])
+			return gnss, eph.SV, eph.IODE, true
+		}
+	case "MGA-GAL-EPH":
+		if len(p) >= 6 {
+			return "gal", int(p[2]), int(binary.LittleEndian.Uint16(p[4:])), true
+		}
+	case "MGA-GLO-EPH", "MGA-BDS-EPH":
+		if len(p) >= 3 {
+			gnss = strings.ToLower(strings.Split(name, "-")[1])
+			return gnss, int(p[2]), -1, true
+		}
+	}
+	return "", 0, 0, false
+}
+
+// filterDelta удаляет из списка эфемериды спутников, для которых у устройства
+// уже есть данные с тем же идентификатором набора, полученные не раньше
+// maxAge назад. Для систем, идентификатор набора данных которых не
+// разбирается, учитывается только возраст данных. Остальные сообщения
+// остаются в списке.
+func filterDelta(msgs []UBXMessage, have []UbloxSatellite,
+	maxAge time.Duration) []UBXMessage {
+	if len(have) == 0 {
+		return msgs
+	}
+	type satellite struct {
+		gnss string
+		sv   int
+	}
+	current := make(map[satellite]int, len(have))
+	for _, sat := range have {
+		if sat.Age <= maxAge {
+			current[satellite{strings.ToLower(sat.GNSS), sat.SV}] = sat.IODE
+		}
+	}
+	result := make([]UBXMessage, 0, len(msgs))
+	for _, msg := range msgs {
+		gnss, sv, iode, ok := ubxEphemerisID(msg)
+		if ok {
+			deviceIODE, found := current[satellite{gnss, sv}]
+			if found && (iode < 0 || iode == deviceIODE) {
+				continue // у устройства уже есть актуальные данные
+			}
+		}
+		result = append(result, msg)
+	}
+	return result
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"encoding/binary"
+	"time"
+)
+
+const (
+	ubxIDAIDALM byte = 0x30 // AID-ALM
+	ubxIDAIDEPH byte = 0x31 // AID-EPH
+
+	// половина интервала аппроксимации эфемерид GPS: эфемериды действительны
+	// в течение двух часов после опорного времени toe
+	gpsEphemerisFit = time.Hour * 2
+	// время действия альманаха
+	almanacValidity = time.Hour * 24 * 14
+)
+
+// ephemerisValidity задает время действия эфемерид, для которых опорное время
+// не разбирается, с момента их получения.
+var ephemerisValidity = map[string]time.Duration{
+	"MGA-GAL-EPH": time.Hour * 2,
+	"MGA-BDS-EPH": time.Hour,
+	"MGA-GLO-EPH": time.Minute * 30,
+}
+
+// ubxExpire возвращает время, до которого действительны все эфемериды и
+// альманахи, содержащиеся в списке сообщений, полученных в указанное время.
+// Если в списке нет ни эфемерид, ни альманахов, то возвращается false.
+func ubxExpire(msgs []UBXMessage, received time.Time) (expire time.Time, ok bool) {
+	for _, msg := range msgs {
+		msgExpire, found := ubxMessageExpire(msg, received)
+		if !found {
+			continue
+		}
+		if !ok || msgExpire.Before(expire) {
+			expire = msgExpire
+			ok = true
+		}
+	}
+	return
+}
+
+// ubxMessageExpire возвращает время окончания действия данных из сообщения.
+func ubxMessageExpire(msg UBXMessage, received time.Time) (time.Time, bool) {
+	if toe, ok := ubxGPSToe(msg); ok {
+		return gpsWeekTime(received, toe).Add(gpsEphemerisFit), true
+	}
+	name := msg.Name()
+	if validity, ok := ephemerisValidity[name]; ok {
+		return received.Add(validity), true
+	}
+	switch name {
+	case "AID-ALM":
+		if len(msg.Payload) <= 8 { // альманах для спутника отсутствует
+			return time.Time{}, false
+		}
+		return received.Add(almanacValidity), true
+	case "MGA-GPS-ALM", "MGA-GAL-ALM", "MGA-BDS-ALM", "MGA-QZSS-ALM",
+		"MGA-GLO-ALM":
+		return received.Add(almanacValidity), true
+	}
+	return time.Time{}, false
+}
+
+// ubxGPSToe возвращает опорное время эфемерид GPS (или QZSS) от начала недели.
+func ubxGPSToe(msg UBXMessage) (time.Duration, bool) {
+	switch name := msg.Name(); {
+	case name == "AID-EPH" && len(msg.Payload) == 104:
+		// слово 10 второго подкадра: биты 1-16 содержат toe
+		word := binary.LittleEndian.Uint32(msg.Payload[68:])
+		return time.Duration((word>>8)&0xFFFF) * 16 * time.Second, true
+	case (name == "MGA-GPS-EPH" || name == "MGA-QZSS-EPH") &&
+		len(msg.Payload) == 68:
+		toe := binary.LittleEndian.Uint16(msg.Payload[40:])
+		return time.Duration(toe) * 16 * time.Second, true
+	}
+	return 0, false
+}
+
+// gpsWeekTime возвращает время, соответствующее времени от начала недели GPS,
+// ближайшее к указанному.
+func gpsWeekTime(near time.Time, tow time.Duration) time.Time {
+	const weekDuration = time.Hour * 24 * 7
+	_, nearTow := gpsTime(near)
+	diff := tow - nearTow
+	switch {
+	case diff > weekDuration/2:
+		diff -= weekDuration
+	case diff < -weekDuration/2:
+		diff += weekDuration
+	}
+	return near.Add(diff)
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"encoding/binary"
+	"math"
+	"time"
+)
+
+const (
+	ubxIDAIDINI byte = 0x01 // AID-INI
+	ubxIDMGAINI byte = 0x40 // MGA-INI-*
+
+	gpsLeapSeconds = 18 // разница между временем GPS и UTC в секундах
+	// точность передаваемого устройству времени: учитывает задержку между
+	// формированием ответа и его получением браслетом
+	ubxTimeAccuracy = time.Second * 2
+	// максимальная погрешность координат в метрах, которую принимает сервис
+	// U-Blox: большее значение при переводе в сантиметры переполнится
+	ubxMaxPacc = 6000000
+)
+
+// gpsEpoch задает начало отсчета времени GPS.
+var gpsEpoch = time.Date(1980, time.January, 6, 0, 0, 0, 0, time.UTC)
+
+// gpsTime возвращает номер недели GPS и время от начала недели для указанного
+// времени.
+func gpsTime(t time.Time) (week int, tow time.Duration) {
+	since := t.Sub(gpsEpoch) + gpsLeapSeconds*time.Second
+	const weekDuration = time.Hour * 24 * 7
+	return int(since / weekDuration), since % weekDuration
+}
+
+// isUBXINI возвращает true, если сообщение содержит данные начальной
+// инициализации времени или координат.
+func isUBXINI(msg UBXMessage) bool {
+	return (msg.Class == ubxClassAID && msg.ID == ubxIDAIDINI) ||
+		(msg.Class == ubxClassMGA && msg.ID == ubxIDMGAINI)
+}
+
+// stripUBXINI удаляет из списка сообщения с данными начальной инициализации.
+func stripUBXINI(msgs []UBXMessage) []UBXMessage {
+	result := make([]UBXMessage, 0, len(msgs))
+	for _, msg := range msgs {
+		if !isUBXINI(msg) {
+			result = append(result, msg)
+		}
+	}
+	return result
+}
+
+// ubxINI возвращает сообщения начальной инициализации с указанным временем,
+// координатами и точностью координат в метрах. Для формата aid формируется
+// сообщение AID-INI, для остальных — MGA-INI-TIME_UTC и MGA-INI-POS_LLH.
+// Точность больше ubxMaxPacc ограничивается этим значением.
+func ubxINI(format string, now time.Time, point Point, pacc uint32) []UBXMessage {
+	now = now.UTC()
+	if pacc > ubxMaxPacc {
+		pacc = ubxMaxPacc
+	}
+	lon := int32(math.Round(point[0] * 1e7))
+	lat := int32(math.Round(point[1] * 1e7))
+	posAcc := pacc * 100 // в сантиметрах
+	le := binary.LittleEndian
+	if format == "aid" {
+		week, tow := gpsTime(now)
+		payload := make([]byte, 48)
+		le.PutUint32(payload[0:], uint32(lat))   // ecefXOrLat
+		le.PutUint32(payload[4:], uint32(lon))   // ecefYOrLon
+		le.PutUint32(payload[8:], 0)             // ecefZOrAlt
+		le.PutUint32(payload[12:], posAcc)       // posAcc
+		le.PutUint16(payload[18:], uint16(week)) // wnoOrDate
+		le.PutUint32(payload[20:], uint32(tow/time.Millisecond))
+		le.PutUint32(payload[24:], uint32(tow%time.Millisecond))
+		le.PutUint32(payload[28:], uint32(ubxTimeAccuracy/time.Millisecond))
+		// координаты и время заданы; координаты в виде широты и долготы,
+		// высота не определена
+		le.PutUint32(payload[44:], 0x01|0x02|0x20|0x40)
+		return []UBXMessage{{Class: ubxClassAID, ID: ubxIDAIDINI, Payload: payload}}
+	}
+	timeUTC := make([]byte, 24)
+	timeUTC[0] = 0x10 // тип: TIME_UTC
+	timeUTC[2] = 0    // время действительно на момент получения сообщения
+	timeUTC[3] = gpsLeapSeconds
+	le.PutUint16(timeUTC[4:], uint16(now.Year()))
+	timeUTC[6] = byte(now.Month())
+	timeUTC[7] = byte(now.Day())
+	timeUTC[8] = byte(now.Hour())
+	timeUTC[9] = byte(now.Minute())
+	timeUTC[10] = byte(now.Second())
+	le.PutUint32(timeUTC[12:], uint32(now.Nanosecond()))
+	le.PutUint16(timeUTC[16:], uint16(ubxTimeAccuracy/time.Second))
+	le.PutUint32(timeUTC[20:], uint32(ubxTimeAccuracy%time.Second))
+	posLLH := make([]byte, 20)
+	posLLH[0] = 0x01 // тип: POS_LLH
+	le.PutUint32(posLLH[4:], uint32(lat))
+	le.PutUint32(posLLH[8:], uint32(lon))
+	le.PutUint32(posLLH[12:], 0) // высота
+	le.PutUint32(posLLH[16:], posAcc)
+	return []UBXMessage{
+		{Class: ubxClassMGA, ID: ubxIDMGAINI, Payload: timeUTC},
+		{Class: ubxClassMGA, ID: ubxIDMGAINI, Payload: posLLH},
+	}
+}
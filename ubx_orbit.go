@@ -0,0 +1,193 @@
+package main
+
+import (
+	"encoding/binary"
+	"math"
+	"time"
+)
+
+const (
+	gpsMu     = 3.986005e14     // гравитационный параметр Земли (WGS84), м³/с²
+	gpsOmegaE = 7.2921151467e-5 // угловая скорость вращения Земли, рад/с
+	wgs84E2   = 6.69437999014e-3
+
+	gpsHalfWeek = 302400.0 // половина недели GPS в секундах
+	// шаг проверки видимости спутника в течение заданного интервала времени
+	visibilityStep = time.Minute * 10
+)
+
+// gpsEphemeris описывает эфемериды спутника GPS (или QZSS), необходимые для
+// вычисления его положения.
+type gpsEphemeris struct {
+	SV       int     // номер спутника
+	IODE     int     // идентификатор набора данных
+	Toe      float64 // опорное время эфемерид от начала недели, с
+	SqrtA    float64 // корень из большой полуоси, м^1/2
+	E        float64 // эксцентриситет
+	M0       float64 // средняя аномалия на опорное время, рад
+	DeltaN   float64 // поправка среднего движения, рад/с
+	Omega0   float64 // долгота восходящего узла, рад
+	I0       float64 // наклонение на опорное время, рад
+	Omega    float64 // аргумент перигея, рад
+	OmegaDot float64 // скорость изменения долготы восходящего узла, рад/с
+	IDot     float64 // скорость изменения наклонения, рад/с
+	Cuc, Cus float64 // поправки аргумента широты, рад
+	Crc, Crs float64 // поправки радиуса орбиты, м
+	Cic, Cis float64 // поправки наклонения, рад
+}
+
+// parseGPSEphemeris разбирает эфемериды спутника GPS из сообщения AID-EPH,
+// MGA-GPS-EPH или MGA-QZSS-EPH. Если сообщение не содержит эфемерид, то
+// возвращается false.
+func parseGPSEphemeris(msg UBXMessage) (eph gpsEphemeris, ok bool) {
+	le := binary.LittleEndian
+	p := msg.Payload
+	switch name := msg.Name(); {
+	case name == "AID-EPH" && len(p) == 104:
+		// слова подкадров содержат по 24 бита данных без контроля четности;
+		// биты нумеруются с 1, начиная со старшего
+		word := func(subframe, n int) uint32 {
+			return le.Uint32(p[8+(subframe-1)*32+(n-3)*4:]) & 0xFFFFFF
+		}
+		field := func(w uint32, start, length int) uint32 {
+			return (w >> uint(25-start-length)) & (1<<uint(length) - 1)
+		}
+		join := func(msb, lsb uint32) uint32 { return msb<<24 | lsb }
+		eph = gpsEphemeris{
+			SV:       int(le.Uint32(p)),
+			IODE:     int(field(word(2, 3), 1, 8)),
+			Crs:      signed(field(word(2, 3), 9, 16), 16) * math.Pow(2, -5),
+			DeltaN:   signed(field(word(2, 4), 1, 16), 16) * math.Pow(2, -43) * math.Pi,
+			M0:       signed(join(field(word(2, 4), 17, 8), word(2, 5)), 32) * math.Pow(2, -31) * math.Pi,
+			Cuc:      signed(field(word(2, 6), 1, 16), 16) * math.Pow(2, -29),
+			E:        float64(join(field(word(2, 6), 17, 8), word(2, 7))) * math.Pow(2, -33),
+			Cus:      signed(field(word(2, 8), 1, 16), 16) * math.Pow(2, -29),
+			SqrtA:    float64(join(field(word(2, 8), 17, 8), word(2, 9))) * math.Pow(2, -19),
+			Toe:      float64(field(word(2, 10), 1, 16)) * 16,
+			Cic:      signed(field(word(3, 3), 1, 16), 16) * math.Pow(2, -29),
+			Omega0:   signed(join(field(word(3, 3), 17, 8), word(3, 4)), 32) * math.Pow(2, -31) * math.Pi,
+			Cis:      signed(field(word(3, 5), 1, 16), 16) * math.Pow(2, -29),
+			I0:       signed(join(field(word(3, 5), 17, 8), word(3, 6)), 32) * math.Pow(2, -31) * math.Pi,
+			Crc:      signed(field(word(3, 7), 1, 16), 16) * math.Pow(2, -5),
+			Omega:    signed(join(field(word(3, 7), 17, 8), word(3, 8)), 32) * math.Pow(2, -31) * math.Pi,
+			OmegaDot: signed(word(3, 9), 24) * math.Pow(2, -43) * math.Pi,
+			IDot:     signed(field(word(3, 10), 9, 14), 14) * math.Pow(2, -43) * math.Pi,
+		}
+		return eph, true
+	case (name == "MGA-GPS-EPH" || name == "MGA-QZSS-EPH") && len(p) == 68:
+		i16 := func(offset int) float64 { return float64(int16(le.Uint16(p[offset:]))) }
+		i32 := func(offset int) float64 { return float64(int32(le.Uint32(p[offset:]))) }
+		eph = gpsEphemeris{
+			SV:       int(p[2]),
+			IODE:     int(le.Uint16(p[8:]) & 0xFF),
+			Crs:      i16(20) * math.Pow(2, -5),
+			DeltaN:   i16(22) * math.Pow(2, -43) * math.Pi,
+			M0:       i32(24) * math.Pow(2, -31) * math.Pi,
+			Cuc:      i16(28) * math.Pow(2, -29),
+			Cus:      i16(30) * math.Pow(2, -29),
+			E:        float64(le.Uint32(p[32:])) * math.Pow(2, -33),
+			SqrtA:    float64(le.Uint32(p[36:])) * math.Pow(2, -19),
+			Toe:      float64(le.Uint16(p[40:])) * 16,
+			Cic:      i16(42) * math.Pow(2, -29),
+			Omega0:   i32(44) * math.Pow(2, -31) * math.Pi,
+			Cis:      i16(48) * math.Pow(2, -29),
+			Crc:      i16(50) * math.Pow(2, -5),
+			I0:       i32(52) * math.Pow(2, -31) * math.Pi,
+			Omega:    i32(56) * math.Pow(2, -31) * math.Pi,
+			OmegaDot: i32(60) * math.Pow(2, -43) * math.Pi,
+			IDot:     i16(64) * math.Pow(2, -43) * math.Pi,
+		}
+		return eph, true
+	}
+	return eph, false
+}
+
+// signed возвращает значение числа в дополнительном коде указанной длины.
+func signed(value uint32, bits uint) float64 {
+	if value&(1<<(bits-1)) != 0 {
+		return float64(int64(value) - 1<<bits)
+	}
+	return float64(value)
+}
+
+// position возвращает координаты спутника в системе ECEF на указанное время
+// по алгоритму из спецификации IS-GPS-200.
+func (eph gpsEphemeris) position(t time.Time) [3]float64 {
+	_, tow := gpsTime(t)
+	tk := tow.Seconds() - eph.Toe
+	switch {
+	case tk > gpsHalfWeek:
+		tk -= 2 * gpsHalfWeek
+	case tk < -gpsHalfWeek:
+		tk += 2 * gpsHalfWeek
+	}
+	a := eph.SqrtA * eph.SqrtA
+	n := math.Sqrt(gpsMu/(a*a*a)) + eph.DeltaN
+	m := eph.M0 + n*tk
+	e := m // решаем уравнение Кеплера
+	for i := 0; i < 10; i++ {
+		e = m + eph.E*math.Sin(e)
+	}
+	v := math.Atan2(math.Sqrt(1-eph.E*eph.E)*math.Sin(e), math.Cos(e)-eph.E)
+	phi := v + eph.Omega
+	sin2, cos2 := math.Sin(2*phi), math.Cos(2*phi)
+	u := phi + eph.Cus*sin2 + eph.Cuc*cos2
+	r := a*(1-eph.E*math.Cos(e)) + eph.Crs*sin2 + eph.Crc*cos2
+	i := eph.I0 + eph.Cis*sin2 + eph.Cic*cos2 + eph.IDot*tk
+	x, y := r*math.Cos(u), r*math.Sin(u)
+	omega := eph.Omega0 + (eph.OmegaDot-gpsOmegaE)*tk - gpsOmegaE*eph.Toe
+	return [3]float64{
+		x*math.Cos(omega) - y*math.Cos(i)*math.Sin(omega),
+		x*math.Sin(omega) + y*math.Cos(i)*math.Cos(omega),
+		y * math.Sin(i),
+	}
+}
+
+// elevation возвращает угол возвышения спутника над горизонтом в градусах для
+// точки на поверхности эллипсоида WGS84.
+func elevation(p Point, sat [3]float64) float64 {
+	lon, lat := p[0]*math.Pi/180, p[1]*math.Pi/180
+	sinLat, cosLat := math.Sin(lat), math.Cos(lat)
+	n := earthRadius / math.Sqrt(1-wgs84E2*sinLat*sinLat)
+	receiver := [3]float64{
+		n * cosLat * math.Cos(lon),
+		n * cosLat * math.Sin(lon),
+		n * (1 - wgs84E2) * sinLat,
+	}
+	up := [3]float64{cosLat * math.Cos(lon), cosLat * math.Sin(lon), sinLat}
+	var dot, length float64
+	for i := range sat {
+		d := sat[i] - receiver[i]
+		dot += d * up[i]
+		length += d * d
+	}
+	return math.Asin(dot/math.Sqrt(length)) * 180 / math.Pi
+}
+
+// filterVisible удаляет из списка эфемериды спутников GPS и QZSS, которые не
+// поднимаются выше маски возвышения в указанной точке в течение интервала
+// времени window, начиная с now. Остальные сообщения, в том числе эфемериды
+// других систем, которые не удалось разобрать, остаются в списке.
+func filterVisible(msgs []UBXMessage, p Point, now time.Time, mask float64,
+	window time.Duration) []UBXMessage {
+	result := make([]UBXMessage, 0, len(msgs))
+	for _, msg := range msgs {
+		eph, ok := parseGPSEphemeris(msg)
+		if !ok || eph.SqrtA == 0 || eph.visible(p, now, mask, window) {
+			result = append(result, msg)
+		}
+	}
+	return result
+}
+
+// visible возвращает true, если спутник поднимается выше маски возвышения в
+// указанной точке в течение интервала времени.
+func (eph gpsEphemeris) visible(p Point, from time.Time, mask float64,
+	window time.Duration) bool {
+	for offset := time.Duration(0); offset <= window; offset += visibilityStep {
+		if elevation(p, eph.position(from.Add(offset))) >= mask {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"encoding/binary"
+	"math"
+	"testing"
+	"time"
+)
+
+func TestParseUBX(t *testing.T) {
+	msgs := []UBXMessage{
+		{Class: ubxClassAID, ID: 0x31, Payload: make([]byte, 8)},
+		{Class: ubxClassMGA, ID: 0x00, Payload: append([]byte{0x01}, make([]byte, 67)...)},
+		{Class: ubxClassMGA, ID: 0x40, Payload: append([]byte{0x10}, make([]byte, 23)...)},
+	}
+	data := MarshalUBX(msgs)
+	parsed, err := ParseUBX(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(parsed) != len(msgs) {
+		t.Fatalf("parsed %d messages, want %d", len(parsed), len(msgs))
+	}
+	summary := UBXSummary(parsed)
+	for _, name := range []string{"AID-EPH", "MGA-GPS-EPH", "MGA-INI-TIME_UTC"} {
+		if summary[name] != 1 {
+			t.Errorf("summary %v: no %s", summary, name)
+		}
+	}
+
+	bad := append([]byte(nil), data...)
+	bad[len(bad)-1]++
+	if _, err := ParseUBX(bad); err != errUBXChecksum {
+		t.Error("checksum error expected, got", err)
+	}
+	if _, err := ParseUBX(data[:len(data)-3]); err != errUBXShort {
+		t.Error("truncated error expected, got", err)
+	}
+	if _, err := ParseUBX([]byte("<html>error</html>")); err != errUBXSync {
+		t.Error("sync error expected, got", err)
+	}
+	if _, err := ParseUBX(nil); err != errUBXEmpty {
+		t.Error("empty error expected, got", err)
+	}
+}
+
+func TestUBXINI(t *testing.T) {
+	now := time.Date(2016, time.October, 9, 12, 30, 15, 0, time.UTC)
+	point := NewPoint(38.67451, 55.715084)
+	for _, format := range []string{"aid", "mga"} {
+		data := MarshalUBX(ubxINI(format, now, point, 1000))
+		msgs, err := ParseUBX(data)
+		if err != nil {
+			t.Fatal(format, err)
+		}
+		if len(stripUBXINI(msgs)) != 0 {
+			t.Errorf("%s: INI messages not stripped: %v", format, UBXSummary(msgs))
+		}
+	}
+	// слишком большая погрешность не переполняется при переводе в сантиметры
+	for _, format := range []string{"aid", "mga"} {
+		msgs := ubxINI(format, now, point, math.MaxUint32)
+		payload := msgs[len(msgs)-1].Payload
+		offset := 16 // posAcc в MGA-INI-POS_LLH
+		if format == "aid" {
+			offset = 12
+		}
+		if acc := binary.LittleEndian.Uint32(payload[offset:]); acc != ubxMaxPacc*100 {
+			t.Errorf("%s: bad clamped accuracy: %d", format, acc)
+		}
+	}
+	week, tow := gpsTime(now)
+	if week != 1918 || tow != time.Hour*12+time.Minute*30+time.Second*33 {
+		t.Error("bad GPS time:", week, tow)
+	}
+}
+
+func TestUBXExpire(t *testing.T) {
+	received := time.Date(2016, time.October, 9, 12, 0, 0, 0, time.UTC)
+	_, tow := gpsTime(received)
+	eph := func(toe time.Duration) UBXMessage {
+		payload := make([]byte, 68)
+		payload[0] = 0x01
+		binary.LittleEndian.PutUint16(payload[40:], uint16(toe/time.Second/16))
+		return UBXMessage{Class: ubxClassMGA, ID: 0x00, Payload: payload}
+	}
+	msgs := []UBXMessage{
+		eph(tow + time.Hour),
+		eph(tow - time.Hour),
+		{Class: ubxClassMGA, ID: 0x00, Payload: append([]byte{0x02}, make([]byte, 35)...)},
+	}
+	expire, ok := ubxExpire(msgs, received)
+	// опорное время эфемерид задается с точностью до 16 секунд
+	if diff := expire.Sub(received.Add(time.Hour)); !ok ||
+		diff <= -time.Second*16 || diff > 0 {
+		t.Error("bad expire:", expire, ok)
+	}
+	if _, ok := ubxExpire(msgs[2:], received); !ok {
+		t.Error("almanac validity ignored")
+	}
+	if _, ok := ubxExpire(nil, received); ok {
+		t.Error("expire for empty data")
+	}
+}
+
+func TestFilterVisible(t *testing.T) {
+	now := time.Date(2016, time.October, 9, 12, 0, 0, 0, time.UTC)
+	_, tow := gpsTime(now)
+	toe := uint16(tow / time.Second / 16)
+	// спутник на круговой экваториальной орбите, в момент toe находящийся
+	// над точкой с нулевыми координатами
+	payload := make([]byte, 68)
+	payload[0], payload[2] = 0x01, 5
+	le := binary.LittleEndian
+	le.PutUint32(payload[36:], uint32(5153.5*(1<<19))) // sqrtA
+	le.PutUint16(payload[40:], toe)
+	omega0 := gpsOmegaE * float64(toe) * 16 / math.Pi * (1 << 31)
+	le.PutUint32(payload[44:], uint32(int32(omega0)))
+	msgs := []UBXMessage{{Class: ubxClassMGA, ID: 0x00, Payload: payload}}
+
+	eph, ok := parseGPSEphemeris(msgs[0])
+	if !ok || eph.SV != 5 {
+		t.Fatal("ephemeris not parsed")
+	}
+	if el := elevation(NewPoint(0, 0), eph.position(now)); el < 80 {
+		t.Error("bad elevation:", el)
+	}
+	if len(filterVisible(msgs, NewPoint(0, 0), now, 5, 0)) != 1 {
+		t.Error("visible satellite filtered")
+	}
+	if len(filterVisible(msgs, NewPoint(180, 0), now, 5, 0)) != 0 {
+		t.Error("invisible satellite not filtered")
+	}
+}
+
+func TestFilterDelta(t *testing.T) {
+	eph := func(sv byte, iodc uint16) UBXMessage {
+		payload := make([]byte, 68)
+		payload[0], payload[2] = 0x01, sv
+		binary.LittleEndian.PutUint16(payload[8:], iodc)
+		return UBXMessage{Class: ubxClassMGA, ID: 0x00, Payload: payload}
+	}
+	msgs := []UBXMessage{
+		eph(1, 10), eph(2, 20), eph(3, 30),
+		{Class: ubxClassMGA, ID: 0x00, Payload: append([]byte{0x02}, make([]byte, 35)...)},
+	}
+	have := []UbloxSatellite{
+		{GNSS: "GPS", SV: 1, IODE: 10, Age: time.Hour},     // актуальные данные
+		{GNSS: "gps", SV: 2, IODE: 19, Age: time.Hour},     // есть более новые
+		{GNSS: "gps", SV: 3, IODE: 30, Age: time.Hour * 3}, // устаревшие данные
+	}
+	result := filterDelta(msgs, have, time.Hour*2)
+	if len(result) != 3 {
+		t.Fatalf("%d messages, want 3", len(result))
+	}
+	if gnss, sv, _, _ := ubxEphemerisID(result[0]); gnss != "gps" || sv != 2 {
+		t.Errorf("bad first message: %s %d", gnss, sv)
+	}
+}
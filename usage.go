@@ -0,0 +1,218 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// errUsageLimit возвращается, если превышено ограничение на количество
+// запросов к внешнему сервису.
+var errUsageLimit = errors.New("usage limit exceeded")
+
+// Usage описывает учет запросов к платным внешним сервисам.
+//
+// Каждый запрос к внешнему сервису учитывается по дням в разрезе сервиса,
+// ключа доступа и устройства. Для ключей доступа могут быть заданы суточные
+// и месячные ограничения: сервис LBS при их превышении переходит к следующему
+// сервису из списка, а сервис U-blox отказывает в запросе новых данных,
+// продолжая отдавать данные из кеша. Ограничения проверяются перед запросом,
+// поэтому при одновременных запросах они могут быть незначительно превышены.
+type Usage struct {
+	Limits []UsageLimit // ограничения на количество запросов
+
+	coll *mgo.Collection // коллекция со статистикой запросов
+}
+
+// UsageLimit описывает ограничение на количество запросов к внешнему сервису.
+// Если токен не задан, то ограничение действует для каждого ключа доступа
+// сервиса.
+type UsageLimit struct {
+	Provider string // название сервиса: google, mozilla, yandex, ublox
+	Token    string // ключ доступа
+	Daily    int64  // ограничение на количество запросов в сутки
+	Monthly  int64  // ограничение на количество запросов в месяц
+}
+
+// UsageReportRequest описывает параметры отчета об использовании сервисов.
+type UsageReportRequest struct {
+	Provider string    // название сервиса
+	Device   string    // идентификатор устройства
+	Devices  bool      // детализация по устройствам
+	From     time.Time // начало периода (по умолчанию начало текущего месяца)
+	To       time.Time // окончание периода (по умолчанию текущее время)
+}
+
+// UsageRecord описывает количество запросов к сервису за сутки.
+type UsageRecord struct {
+	Date     string // дата в формате 2006-01-02 (UTC)
+	Provider string // название сервиса
+	Key      string // идентификатор ключа доступа
+	Device   string // идентификатор устройства
+	Count    int64  // количество запросов
+}
+
+// usageKey возвращает идентификатор ключа доступа для сохранения в
+// статистике: сами ключи в базе данных не хранятся.
+func usageKey(token string) string {
+	if token == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:4])
+}
+
+// usageID возвращает идентификатор записи статистики. Записи с суммарным
+// количеством запросов по ключу доступа не содержат устройства.
+func usageID(period, provider, key string, device *string) string {
+	if device == nil {
+		return fmt.Sprintf("%s|%s|%s", period, provider, key)
+	}
+	return fmt.Sprintf("%s|%s|%s|%s", period, provider, key, *device)
+}
+
+// limit возвращает ограничение для ключа доступа сервиса.
+func (u *Usage) limit(provider, token string) *UsageLimit {
+	var found *UsageLimit
+	for i, limit := range u.Limits {
+		if limit.Provider != provider {
+			continue
+		}
+		if limit.Token == token {
+			return &u.Limits[i]
+		}
+		if limit.Token == "" {
+			found = &u.Limits[i]
+		}
+	}
+	return found
+}
+
+// allow проверяет, что ограничения на количество запросов к сервису с
+// указанным ключом доступа не превышены. Ошибки доступа к базе данных не
+// блокируют запросы.
+func (u *Usage) allow(provider, token string) error {
+	if u == nil {
+		return nil
+	}
+	limit := u.limit(provider, token)
+	if limit == nil || (limit.Daily <= 0 && limit.Monthly <= 0) {
+		return nil
+	}
+	now := time.Now().UTC()
+	key := usageKey(token)
+	day := usageID(now.Format("2006-01-02"), provider, key, nil)
+	month := usageID(now.Format("2006-01"), provider, key, nil)
+	session := u.coll.Database.Session.Copy()
+	defer session.Close()
+	coll := session.DB(u.coll.Database.Name).C(u.coll.Name)
+	var totals []struct {
+		ID    string `bson:"_id"`
+		Count int64
+	}
+	err := coll.Find(bson.M{"_id": bson.M{"$in": []string{day, month}}}).
+		Select(bson.M{"count": 1}).All(&totals)
+	if err != nil {
+		log.Println("USAGE: error:", err)
+		return nil
+	}
+	for _, total := range totals {
+		switch {
+		case total.ID == day && limit.Daily > 0 && total.Count >= limit.Daily,
+			total.ID == month && limit.Monthly > 0 && total.Count >= limit.Monthly:
+			return errUsageLimit
+		}
+	}
+	return nil
+}
+
+// record учитывает запрос к сервису: увеличивает количество запросов
+// устройства за сутки и суммарное количество запросов по ключу доступа за
+// сутки и за месяц.
+func (u *Usage) record(provider, token, device string) {
+	if u == nil {
+		return
+	}
+	now := time.Now().UTC()
+	date := now.Format("2006-01-02")
+	key := usageKey(token)
+	session := u.coll.Database.Session.Copy()
+	defer session.Close()
+	coll := session.DB(u.coll.Database.Name).C(u.coll.Name)
+	bulk := coll.Bulk()
+	bulk.Unordered()
+	for _, item := range []struct {
+		period string
+		device *string
+	}{
+		{date, &device},
+		{date, nil},
+		{now.Format("2006-01"), nil},
+	} {
+		set := bson.M{
+			"date":     item.period,
+			"provider": provider,
+			"key":      key,
+			"total":    item.device == nil,
+		}
+		if item.device != nil {
+			set["device"] = *item.device
+		}
+		bulk.Upsert(bson.M{"_id": usageID(item.period, provider, key, item.device)},
+			bson.M{"$set": set, "$inc": bson.M{"count": 1}})
+	}
+	if _, err := bulk.Run(); err != nil {
+		log.Println("USAGE: error:", err)
+	}
+}
+
+// Report возвращает количество запросов к внешним сервисам по дням. Если не
+// задано устройство или детализация по устройствам, то возвращается
+// суммарное количество запросов по ключам доступа.
+func (u *Usage) Report(req UsageReportRequest, records *[]UsageRecord) error {
+	if u.coll == nil {
+		return errors.New("USAGE: service not initialized")
+	}
+	now := time.Now().UTC()
+	if req.To.IsZero() {
+		req.To = now
+	}
+	if req.From.IsZero() {
+		req.From = time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+	}
+	if req.From.After(req.To) {
+		return errors.New("USAGE: bad period")
+	}
+	// месячные записи отличаются форматом даты и в отчет не попадают
+	query := bson.M{
+		"date": bson.M{
+			"$gte":   req.From.UTC().Format("2006-01-02"),
+			"$lte":   req.To.UTC().Format("2006-01-02"),
+			"$regex": `^\d{4}-\d{2}-\d{2}$`,
+		},
+		"total": req.Device == "" && !req.Devices,
+	}
+	if req.Provider != "" {
+		query["provider"] = req.Provider
+	}
+	if req.Device != "" {
+		query["device"] = req.Device
+	}
+	session := u.coll.Database.Session.Copy()
+	defer session.Close()
+	coll := session.DB(u.coll.Database.Name).C(u.coll.Name)
+	list := []UsageRecord{}
+	err := coll.Find(query).Select(bson.M{"_id": 0, "total": 0}).
+		Sort("date", "provider", "key", "device").All(&list)
+	if err != nil {
+		return err
+	}
+	*records = list
+	return nil
+}